@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/BurntSushi/toml"
@@ -22,7 +23,57 @@ type ApiConfig struct {
 }
 
 type SidecarConfig struct {
-	StateUrl string `toml:"state_url" split_words:"true"`
+	StateUrl string         `toml:"state_url" split_words:"true"`
+	Sources  []SourceConfig `toml:"sources" ignored:"true"`
+
+	// TLS and auth for talking to Sidecar
+	UseTLS      bool   `toml:"use_tls" split_words:"true"`
+	CAFile      string `toml:"ca_file" split_words:"true"`
+	CertFile    string `toml:"cert_file" split_words:"true"`
+	KeyFile     string `toml:"key_file" split_words:"true"`
+	BearerToken string `toml:"bearer_token" split_words:"true"`
+
+	// How follow mode reconnects to Sidecar
+	FollowRefresh      haproxy.Duration `toml:"follow_refresh" split_words:"true"`
+	FollowStallTimeout haproxy.Duration `toml:"follow_stall_timeout" split_words:"true"`
+	FollowMinBackoff   haproxy.Duration `toml:"follow_min_backoff" split_words:"true"`
+	FollowMaxBackoff   haproxy.Duration `toml:"follow_max_backoff" split_words:"true"`
+}
+
+// A named Sidecar cluster to merge state from
+type SourceConfig struct {
+	Name     string `toml:"name"`
+	StateUrl string `toml:"state_url"`
+}
+
+// The configured sources, or a single default one using StateUrl when there
+// aren't any
+func (c *SidecarConfig) sourceConfigs() []SourceConfig {
+	if c == nil {
+		return []SourceConfig{{Name: DefaultSourceName}}
+	}
+
+	if len(c.Sources) < 1 {
+		return []SourceConfig{{Name: DefaultSourceName, StateUrl: c.StateUrl}}
+	}
+
+	return c.Sources
+}
+
+// Make sure every source has a unique name, since we route updates by it
+func validateSources(sources []SourceConfig) error {
+	seen := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		if source.Name == "" {
+			return fmt.Errorf("Sidecar source with state_url '%s' has no name", source.StateUrl)
+		}
+		if seen[source.Name] {
+			return fmt.Errorf("Duplicate Sidecar source '%s'", source.Name)
+		}
+		seen[source.Name] = true
+	}
+
+	return nil
 }
 
 func parseConfig(path string) *Config {
@@ -46,16 +97,45 @@ func parseConfig(path string) *Config {
 	// Set some defaults if not provided. These should mostly
 	// do the right thing unless this is not running in the
 	// standard Docker container.
+	switch proxy.Mode {
+	case "":
+		proxy.Mode = haproxy.ModeDaemon
+	case haproxy.ModeDaemon, haproxy.ModeMasterWorker, haproxy.ModeSupervised:
+	default:
+		log.Errorf("Unknown HAproxy mode '%s'", proxy.Mode)
+		os.Exit(1)
+	}
+
+	if config.Sidecar != nil {
+		err = validateSources(config.Sidecar.Sources)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if proxy.MasterSocket == "" {
+		proxy.MasterSocket = haproxy.DefaultMasterSocket
+	}
+
 	if proxy.ReloadCmd == "" {
-		proxy.ReloadCmd = "haproxy -f " + proxy.ConfigFile + " -p " +
-			proxy.PidFile + " `[[ -f " +
-			proxy.PidFile + " ]] && echo \"-sf $(cat " + proxy.PidFile + ")\"`"
+		proxy.ReloadCmd = proxy.DefaultReloadCmd()
 	}
 
 	if proxy.VerifyCmd == "" {
 		proxy.VerifyCmd = "haproxy -c -f " + proxy.ConfigFile
 	}
 
+	err = proxy.CheckVerifyCmd()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if proxy.StatsSocket == "" {
+		proxy.StatsSocket = haproxy.DefaultStatsSocket
+	}
+
 	if config.HAproxyApi.BindIP == "" {
 		config.HAproxyApi.BindIP = "0.0.0.0"
 	}
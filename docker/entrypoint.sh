@@ -0,0 +1,12 @@
+#!/bin/sh
+
+# stderr -> stdout
+exec 2>&1
+
+# The logging level variable from before haproxy-api ran HAproxy itself
+if [ -n "$HAPROXYAPI_LOGGING_LEVEL" ] && [ -z "$HAPROXY_API_HAPROXY_API_LOGGING_LEVEL" ]; then
+    export HAPROXY_API_HAPROXY_API_LOGGING_LEVEL="$HAPROXYAPI_LOGGING_LEVEL"
+fi
+
+# exec so that we get the signals from "docker stop" and can stop HAproxy
+exec ./haproxy-api -f haproxy-api.toml
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/receiver"
 	"github.com/mitchellh/go-ps"
 	"github.com/relistan/go-director"
@@ -14,58 +18,154 @@ import (
 )
 
 // Loops in the background, waiting to be notified that something
-// has changed. When a change is received, we fetch the new state
-// (what we got wasn't in a useful format) and notify HAproxy.
-func processFollower(url string, looper director.Looper, notifyChan chan struct{}, rcvr *receiver.Receiver) {
+// has changed. We build the new state from the services the watcher
+// streamed to us and notify HAproxy. The full state is only fetched from
+// the Sidecar we're following on startup, or when the stream couldn't be
+// decoded.
+func processFollower(watcher *SidecarWatcher, looper director.Looper, rcvr *receiver.Receiver) {
+	fetchFollowedState(watcher, rcvr)
+
 	looper.Loop(func() error {
-		<-notifyChan
-		state, err := receiver.FetchState(url)
-		if err != nil {
-			log.Errorf("Unable to fetch Sidecar state: %s", err.Error())
+		services := <-watcher.notifyChan
+		if services == nil {
+			fetchFollowedState(watcher, rcvr)
 			return nil
 		}
 
-		// Replace the current state with the new one
-		rcvr.StateLock.Lock()
-		rcvr.CurrentState = state
-		rcvr.StateLock.Unlock()
-
-		rcvr.EnqueueUpdate()
+		updateFollowedState(rcvr, stateFromServices(services))
 		return nil
 	})
 }
 
-// When we're in follow mode, do the business
-func handleFollowing(stateUrl string, watchUrl string, watchLooper director.Looper, processLooper director.Looper, rcvr *receiver.Receiver) {
-	notifyChan := make(chan struct{})
+// Fetch the full state from the Sidecar we're following
+func fetchFollowedState(watcher *SidecarWatcher, rcvr *receiver.Receiver) {
+	followerStateFetchesTotal.Inc()
+	state, err := watcher.sidecar.FetchState(watcher.StateUrl())
+	if err != nil {
+		log.Errorf("Unable to fetch Sidecar state: %s", err.Error())
+		return
+	}
+
+	updateFollowedState(rcvr, state)
+}
+
+// Replace the current state with the new one
+func updateFollowedState(rcvr *receiver.Receiver, state *catalog.ServicesState) {
+	rcvr.StateLock.Lock()
+	rcvr.CurrentState = state
+	rcvr.StateLock.Unlock()
+
+	rcvr.EnqueueUpdate()
+}
+
+// Build a state from the services streamed by /watch, which are grouped by
+// service name rather than by server. The state's LastChanged is the most
+// recent update of any service.
+func stateFromServices(services WatchUpdate) *catalog.ServicesState {
+	state := catalog.NewServicesState()
+
+	for _, svcList := range services {
+		for _, svc := range svcList {
+			if svc == nil {
+				continue
+			}
+
+			server, ok := state.Servers[svc.Hostname]
+			if !ok {
+				server = catalog.NewServer(svc.Hostname)
+				state.Servers[svc.Hostname] = server
+			}
+			server.Services[svc.ID] = svc
+
+			if svc.Updated.After(server.LastUpdated) {
+				server.LastUpdated = svc.Updated
+				server.LastChanged = svc.Updated
+			}
+			if svc.Updated.After(state.LastChanged) {
+				state.LastChanged = svc.Updated
+			}
+		}
+	}
+
+	return state
+}
 
-	go processFollower(stateUrl, processLooper, notifyChan, rcvr)
+// When we're in follow mode, do the business
+func handleFollowing(watcher *SidecarWatcher, processLooper director.Looper, rcvr *receiver.Receiver) {
+	go processFollower(watcher, processLooper, rcvr)
 
-	watcher := NewSidecarWatcher(watchUrl, watchLooper, notifyChan)
 	watcher.Follow()
 }
 
-// Construct the watch and state URLs from the opts and config provided
-func generateUrls(opts *CliOpts, config *Config) (watchUrl string, stateUrl string) {
-	if *opts.Follow == "" {
-		stateUrl = config.Sidecar.StateUrl
-	} else {
-		stateTmp, err := url.Parse("http://" + *opts.Follow)
-		if err != nil {
-			log.Fatalf("Unable to follow %s: %s", *opts.Follow, err)
+// Parse the comma separated list of ip:port addresses given to --follow
+// into the watch and state URLs for each Sidecar, in failover order. The
+// scheme is "http" or "https".
+func parseFollowTargets(follow string, scheme string) ([]FollowTarget, error) {
+	var targets []FollowTarget
+	for _, address := range strings.Split(follow, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
 		}
-		stateTmp.Path = "/api/state.json"
-		stateUrl = stateTmp.String()
 
-		watchTmp, err := url.Parse("http://" + *opts.Follow)
+		base, err := url.Parse(scheme + "://" + address)
 		if err != nil {
-			log.Fatalf("Unable to follow %s: %s", *opts.Follow, err)
+			return nil, fmt.Errorf("Unable to follow %s: %s", address, err)
+		}
+		if base.Host == "" || base.Path != "" {
+			return nil, fmt.Errorf("Unable to follow %s: expected ip:port", address)
 		}
-		watchTmp.Path = "/watch"
-		watchUrl = watchTmp.String()
+
+		stateUrl := *base
+		stateUrl.Path = "/api/state.json"
+		watchUrl := *base
+		watchUrl.Path = "/watch"
+
+		targets = append(targets, FollowTarget{
+			Address:  address,
+			WatchUrl: watchUrl.String(),
+			StateUrl: stateUrl.String(),
+		})
 	}
 
-	return watchUrl, stateUrl
+	if len(targets) < 1 {
+		return nil, fmt.Errorf("No Sidecar addresses to follow in '%s'", follow)
+	}
+
+	return targets, nil
+}
+
+// Apply the refresh and backoff settings to the watcher. Flags win over the
+// config file, and anything set in neither keeps the watcher's default.
+func configureWatcher(watcher *SidecarWatcher, opts *CliOpts, config *SidecarConfig) error {
+	pick := func(flag *time.Duration, setting haproxy.Duration, current time.Duration) time.Duration {
+		switch {
+		case flag != nil && *flag > 0:
+			return *flag
+		case setting.Duration > 0:
+			return setting.Duration
+		default:
+			return current
+		}
+	}
+
+	if config == nil {
+		config = &SidecarConfig{}
+	}
+
+	watcher.RefreshConn = pick(opts.FollowRefresh, config.FollowRefresh, watcher.RefreshConn)
+	watcher.StallTimeout = pick(opts.FollowStallTimeout, config.FollowStallTimeout, watcher.StallTimeout)
+	watcher.MinBackoff = pick(opts.FollowMinBackoff, config.FollowMinBackoff, watcher.MinBackoff)
+	watcher.MaxBackoff = pick(opts.FollowMaxBackoff, config.FollowMaxBackoff, watcher.MaxBackoff)
+
+	if watcher.MinBackoff > watcher.MaxBackoff {
+		return fmt.Errorf("Follow min backoff (%s) is longer than the max (%s)", watcher.MinBackoff, watcher.MaxBackoff)
+	}
+
+	log.Infof("Following with refresh %s, stall timeout %s and backoff %s to %s",
+		watcher.RefreshConn, watcher.StallTimeout, watcher.MinBackoff, watcher.MaxBackoff)
+
+	return nil
 }
 
 // See if the pid file and a running process match. Otherwise
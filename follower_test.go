@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/receiver"
+	"github.com/Nitro/sidecar/service"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_configureWatcher(t *testing.T) {
+	Convey("configureWatcher()", t, func() {
+		log.SetLevel(log.ErrorLevel)
+
+		watcher := NewSidecarWatcher(exampleTargets, plainSidecar, director.NewFreeLooper(1, nil), nil)
+		var noFlag time.Duration
+		opts := &CliOpts{FollowRefresh: &noFlag, FollowStallTimeout: &noFlag, FollowMinBackoff: &noFlag, FollowMaxBackoff: &noFlag}
+		config := &SidecarConfig{}
+
+		Convey("keeps the defaults when nothing is set", func() {
+			So(configureWatcher(watcher, opts, config), ShouldBeNil)
+			So(watcher.RefreshConn, ShouldEqual, CONNECTION_REFRESH_TIME)
+			So(watcher.StallTimeout, ShouldEqual, STALL_TIMEOUT)
+			So(watcher.MinBackoff, ShouldEqual, MIN_BACKOFF)
+			So(watcher.MaxBackoff, ShouldEqual, MAX_BACKOFF)
+		})
+
+		Convey("uses the config file, with flags taking precedence", func() {
+			config.FollowRefresh = haproxy.Duration{Duration: 1 * time.Minute}
+			config.FollowMaxBackoff = haproxy.Duration{Duration: 2 * time.Minute}
+			config.FollowStallTimeout = haproxy.Duration{Duration: 1 * time.Minute}
+			refresh := 30 * time.Second
+			opts.FollowRefresh = &refresh
+
+			So(configureWatcher(watcher, opts, config), ShouldBeNil)
+			So(watcher.RefreshConn, ShouldEqual, 30*time.Second)
+			So(watcher.MinBackoff, ShouldEqual, MIN_BACKOFF)
+			So(watcher.MaxBackoff, ShouldEqual, 2*time.Minute)
+			So(watcher.StallTimeout, ShouldEqual, 1*time.Minute)
+		})
+
+		Convey("rejects a min backoff longer than the max", func() {
+			config.FollowMinBackoff = haproxy.Duration{Duration: 5 * time.Minute}
+
+			So(configureWatcher(watcher, opts, config), ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_processFollower(t *testing.T) {
+	Convey("processFollower()", t, func() {
+		log.SetLevel(log.FatalLevel)
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		// A Sidecar that counts how often its full state is fetched
+		var fetches int32
+		fetched := catalog.NewServicesState()
+		fetched.AddServiceEntry(service.Service{ID: "deadbeef000", Name: "fetched", Hostname: "chaucer", Updated: baseTime})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			w.Write(fetched.Encode())
+		}))
+		defer server.Close()
+
+		targets, _ := parseFollowTargets(strings.TrimPrefix(server.URL, "http://"), "http")
+		notifyChan := make(chan WatchUpdate, 10)
+		watcher := NewSidecarWatcher(targets, plainSidecar, director.NewFreeLooper(1, nil), notifyChan)
+		rcvr := &receiver.Receiver{ReloadChan: make(chan time.Time, 10)}
+
+		Convey("fetches the full state on startup", func() {
+			notifyChan <- WatchUpdate{}
+			processFollower(watcher, director.NewFreeLooper(1, nil), rcvr)
+
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 1)
+		})
+
+		Convey("builds the state from the streamed services", func() {
+			notifyChan <- WatchUpdate{
+				"bocaccio": {
+					{ID: "deadbeef123", Name: "bocaccio", Hostname: "chaucer", Updated: baseTime, Status: service.ALIVE},
+					{ID: "deadbeef456", Name: "bocaccio", Hostname: "dante", Updated: baseTime.Add(time.Second), Status: service.DRAINING},
+				},
+			}
+			processFollower(watcher, director.NewFreeLooper(1, nil), rcvr)
+
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 1)
+			So(rcvr.CurrentState.Servers["chaucer"].HasService("deadbeef123"), ShouldBeTrue)
+			So(rcvr.CurrentState.Servers["dante"].Services["deadbeef456"].IsDraining(), ShouldBeTrue)
+			So(rcvr.CurrentState.LastChanged, ShouldEqual, baseTime.Add(time.Second))
+			So(len(rcvr.ReloadChan), ShouldEqual, 2)
+		})
+
+		Convey("fetches the full state when the stream couldn't be decoded", func() {
+			notifyChan <- nil
+			processFollower(watcher, director.NewFreeLooper(1, nil), rcvr)
+
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 2)
+			So(rcvr.CurrentState.Servers["chaucer"].HasService("deadbeef000"), ShouldBeTrue)
+		})
+	})
+}
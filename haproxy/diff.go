@@ -0,0 +1,52 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// CurrentConfig returns the main config that was last applied to HAproxy. If
+// we haven't applied one yet, it falls back to what is on disk in ConfigFile.
+func (h *HAproxy) CurrentConfig() ([]byte, error) {
+	h.applyLock.Lock()
+	config := h.lastApplied
+	h.applyLock.Unlock()
+
+	if config != nil {
+		return config, nil
+	}
+
+	config, err := ioutil.ReadFile(h.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("No config has been applied yet: %s", err)
+	}
+
+	return config, nil
+}
+
+// ConfigDiff returns a unified diff between the last two configs that were
+// successfully applied to HAproxy.
+func (h *HAproxy) ConfigDiff() (string, error) {
+	h.applyLock.Lock()
+	previous, last := h.previousApplied, h.lastApplied
+	h.applyLock.Unlock()
+
+	if previous == nil || last == nil {
+		return "", fmt.Errorf("Fewer than two configs have been applied")
+	}
+
+	return unifiedDiff(previous, last, "previous", "current")
+}
+
+// Return a unified diff of two configs, with a few lines of context
+func unifiedDiff(from []byte, to []byte, fromName string, toName string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(from)),
+		B:        difflib.SplitLines(string(to)),
+		FromFile: fromName,
+		ToFile:   toName,
+		Context:  3,
+	})
+}
@@ -0,0 +1,24 @@
+package haproxy
+
+import (
+	"time"
+)
+
+// A Duration is a time.Duration that can be decoded from config files and
+// environment variables in the form "500ms", "2s", "1m30s", etc.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText is part of the encoding.TextUnmarshaler interface and is
+// used by both the TOML decoder and envconfig.
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText is part of the encoding.TextMarshaler interface
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
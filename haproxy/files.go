@@ -0,0 +1,108 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CandidateSuffix = ".new"       // Appended to a file name while it is being verified
+	LastGoodSuffix  = ".last-good" // Appended to a file name to store the last known good copy
+)
+
+// WriteFileAtomic writes data to a temp file in the same directory as path,
+// syncs it to disk, and then renames it over path. Readers will either see the old file or the new one,
+// never a partially written one.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for %s: %s", path, err)
+	}
+	tmpName := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("Unable to write %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// Atomically copy the contents of src over dst
+func copyFileAtomic(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(dst, data, 0644)
+}
+
+// Returns true if the file exists on disk
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// The contents of a file at some point, so it can be put back
+type fileSnapshot struct {
+	path   string
+	data   []byte
+	exists bool
+}
+
+// Read the current contents of each file so they can be put back exactly as
+// they were with restoreFiles
+func snapshotFiles(paths []string) ([]fileSnapshot, error) {
+	var snapshots []fileSnapshot
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Unable to read %s: %s", path, err)
+		}
+		snapshots = append(snapshots, fileSnapshot{path: path, data: data, exists: err == nil})
+	}
+
+	return snapshots, nil
+}
+
+// Put files back the way snapshotFiles found them, removing the ones that
+// didn't exist
+func restoreFiles(snapshots []fileSnapshot) error {
+	var failed []string
+	for _, snapshot := range snapshots {
+		var err error
+		if snapshot.exists {
+			err = WriteFileAtomic(snapshot.path, snapshot.data, 0644)
+		} else if err = os.Remove(snapshot.path); os.IsNotExist(err) {
+			err = nil
+		}
+
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to restore %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package haproxy
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"text/template"
@@ -18,63 +21,119 @@ import (
 
 	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/service"
+	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 )
 
-type portset map[string]string
-type portmap map[string]portset
+const (
+	DefaultStatsSocket = "/var/run/haproxy_stats.sock"
+	ConfigPlaceholder  = "{{config}}" // Where the config to check goes in VerifyCmd
+)
+
+// An Outcome describes what the last WriteAndReload() did
+type Outcome string
+
+const (
+	OutcomeNone       Outcome = ""
+	OutcomeReloaded   Outcome = "reloaded"
+	OutcomeRuntimeApi Outcome = "applied via runtime API"
+	OutcomeUnchanged  Outcome = "skipped, unchanged"
+	OutcomeFailed     Outcome = "failed"
+)
+
+type portset map[string]string     // ServicePort -> Port
+type portmap map[string]typedPorts // Service name -> ports
+type typedPorts map[string]portset // Port type ("tcp", "udp") -> ports
 
 // Configuration and state for the HAproxy management module
 type HAproxy struct {
-	ReloadCmd      string `toml:"reload_cmd"`
-	VerifyCmd      string `toml:"verify_cmd"`
-	BindIP         string `toml:"bind_ip"`
-	Template       string `toml:"template"`
-	ConfigFile     string `toml:"config_file"`
-	PidFile        string `toml:"pid_file"`
-	User           string `toml:"user"`
-	Group          string `toml:"group"`
-	UseHostnames   bool   `toml:"use_hostnames"`
-	eventChannel   chan catalog.ChangeEvent
-	signalsHandled bool
-	sigLock        sync.Mutex
-	sigStopChan    chan struct{}
+	ReloadCmd         string        `toml:"reload_cmd"`
+	VerifyCmd         string        `toml:"verify_cmd"`
+	BindIP            string        `toml:"bind_ip"`
+	Template          string        `toml:"template"`
+	ConfigFile        string        `toml:"config_file"`
+	PidFile           string        `toml:"pid_file"`
+	User              string        `toml:"user"`
+	Group             string        `toml:"group"`
+	UseHostnames      bool          `toml:"use_hostnames"`
+	StatsSocket       string        `toml:"stats_socket"`
+	UseRuntimeApi     bool          `toml:"use_runtime_api"`
+	HealthCheckSocket bool          `toml:"health_check_socket"`
+	Mode              string        `toml:"mode"`
+	MasterSocket      string        `toml:"master_socket"`
+	ReloadDebounce    Duration      `toml:"reload_debounce"`
+	ReloadMinInterval Duration      `toml:"reload_min_interval"`
+	ReloadMaxDelay    Duration      `toml:"reload_max_delay"`
+	Outputs           []Output      `toml:"outputs"`
+	TLS               *TLSConfig    `toml:"tls"`
+	Vhosts            *VhostsConfig `toml:"vhosts"`
+	OverridesFile     string        `toml:"overrides_file"`
+	HealthCheck       HealthCheck   `toml:"health_check"`
+	eventChannel      chan catalog.ChangeEvent
+	applyLock         sync.Mutex
+	lastApplied       []byte
+	previousApplied   []byte
+	lastOutcome       Outcome
+	lastHashes        map[string]string
+	lastCertsHash     string
+	templateLock      sync.RWMutex
+	templates         map[string]*loadedTemplate
+	templatesSeen     map[string]time.Time
+	overridesLock     sync.RWMutex
+	overrides         *Overrides
+	overridesSeen     time.Time
+	sourcesLock       sync.RWMutex
+	sources           map[string]string
+	signalsHandled    bool
+	sigLock           sync.Mutex
+	sigStopChan       chan struct{}
+	supervisor        *Supervisor
+	supervisorLock    sync.Mutex
 }
 
 // Constructs a properly configured HAProxy and returns a pointer to it
 func New(configFile string, pidFile string) *HAproxy {
-	reloadCmd := "haproxy -f " + configFile + " -p " + pidFile + " `[[ -f " + pidFile + " ]] && echo \"-sf $(cat " + pidFile + ")\"`"
 	verifyCmd := "haproxy -c -f " + configFile
 
 	proxy := HAproxy{
-		ReloadCmd:  reloadCmd,
-		VerifyCmd:  verifyCmd,
-		Template:   "views/haproxy.cfg",
-		ConfigFile: configFile,
-		PidFile:    pidFile,
+		VerifyCmd:    verifyCmd,
+		Template:     "views/haproxy.cfg",
+		ConfigFile:   configFile,
+		PidFile:      pidFile,
+		StatsSocket:  DefaultStatsSocket,
+		Mode:         ModeDaemon,
+		MasterSocket: DefaultMasterSocket,
 	}
+	proxy.ReloadCmd = proxy.DefaultReloadCmd()
 
 	return &proxy
 }
 
-// Returns a map of ServicePort:Port pairs
+// Returns a map of ServicePort:Port pairs for each service, grouped by the
+// port type
 func (h *HAproxy) makePortmap(services map[string][]*service.Service) portmap {
 	ports := make(portmap)
 
 	for svcName, svcList := range services {
 		if _, ok := ports[svcName]; !ok {
-			ports[svcName] = make(portset, 5)
+			ports[svcName] = make(typedPorts, 2)
 		}
 
 		for _, service := range svcList {
 			for _, port := range service.Ports {
-				// Currently only handle TCP, and we skip ports that aren't exported.
-				// That's the effect of not specifying a ServicePort.
-				if port.Type == "tcp" && port.ServicePort != 0 {
-					svcPort := strconv.FormatInt(port.ServicePort, 10)
-					internalPort := strconv.FormatInt(port.Port, 10)
-					ports[svcName][svcPort] = internalPort
+				// We skip ports that aren't exported. That's the effect of not
+				// specifying a ServicePort.
+				if port.ServicePort == 0 {
+					continue
+				}
+
+				if _, ok := ports[svcName][port.Type]; !ok {
+					ports[svcName][port.Type] = make(portset, 5)
 				}
+
+				svcPort := strconv.FormatInt(port.ServicePort, 10)
+				internalPort := strconv.FormatInt(port.Port, 10)
+				ports[svcName][port.Type][svcPort] = internalPort
 			}
 		}
 	}
@@ -82,14 +141,36 @@ func (h *HAproxy) makePortmap(services map[string][]*service.Service) portmap {
 	return ports
 }
 
+// Returns the sorted list of port types a service exposes
+func (p portmap) typesFor(svcName string) []string {
+	var types []string
+	for portType := range p[svcName] {
+		types = append(types, portType)
+	}
+
+	sort.Strings(types)
+	return types
+}
+
 // Clean up image names for writing as HAproxy frontend and backend entries
 func sanitizeName(image string) string {
 	replace := regexp.MustCompile("[^a-z0-9-]")
 	return replace.ReplaceAllString(image, "-")
 }
 
-// Find a matching Port when given a ServicePort
+// Find a matching Port when given a ServicePort. TCP ports are preferred if a
+// service uses the same ServicePort for more than one port type.
 func findPortForService(svcPort string, svc *service.Service) string {
+	if port := findPortForServiceByType(svcPort, "tcp", svc); port != "-1" {
+		return port
+	}
+
+	return findPortForServiceByType(svcPort, "", svc)
+}
+
+// Find a matching Port of the given type when given a ServicePort. An empty
+// type matches any port.
+func findPortForServiceByType(svcPort string, portType string, svc *service.Service) string {
 	matchPort, err := strconv.ParseInt(svcPort, 10, 64)
 	if err != nil {
 		log.Errorf("Invalid value from template ('%s') can't parse as int64: %s", svcPort, err.Error())
@@ -97,7 +178,7 @@ func findPortForService(svcPort string, svc *service.Service) string {
 	}
 
 	for _, port := range svc.Ports {
-		if port.ServicePort == matchPort {
+		if port.ServicePort == matchPort && (portType == "" || port.Type == portType) {
 			internalPort := strconv.FormatInt(port.Port, 10)
 			return internalPort
 		}
@@ -136,60 +217,171 @@ func (h *HAproxy) findIpForService(svcPort string, svc *service.Service) string
 // Create an HAproxy config from the supplied ServicesState. Write it out to the
 // supplied io.Writer interface. This gets a list from servicesWithPorts() and
 // builds a list of unique ports for all services, then passes these to the
-// template. Ports are looked up by the func getPorts().
+// template. TCP ports are looked up by the func getPorts(), and ports of other
+// types (e.g. "udp") by getPortsByType(). Only the main template is rendered,
+// not any extra Outputs.
 func (h *HAproxy) WriteConfig(state *catalog.ServicesState, output io.Writer) error {
+	start := time.Now()
+	config, err := h.renderMain(state)
+	observeRender(start, err)
+	if err != nil {
+		return err
+	}
 
-	state.RLock()
-	services := servicesWithPorts(state)
-	ports := h.makePortmap(services)
-	modes := getModes(state)
-	state.RUnlock()
-
-	data := struct {
-		Services map[string][]*service.Service
-		User     string
-		Group    string
-	}{
-		Services: services,
-		User:     h.User,
-		Group:    h.Group,
+	// This is the potentially slowest bit, do it outside the critical section
+	_, err = output.Write(config)
+	if err != nil {
+		return fmt.Errorf("Error writing template '%s': %s", h.Template, err.Error())
 	}
 
-	funcMap := template.FuncMap{
+	return nil
+}
+
+// Render the main config from the state. This records no metrics, so that
+// previews can use it too.
+func (h *HAproxy) renderMain(state *catalog.ServicesState) ([]byte, error) {
+	return h.render(state, h.newRenderContext(state), h.Template)
+}
+
+// The functions available to the template, bound to the data for one render
+func (h *HAproxy) templateFuncs(services map[string][]*service.Service, modes map[string]string, ports portmap) template.FuncMap {
+	return template.FuncMap{
 		"now": time.Now().UTC,
+		"servicesFor": func(k string, svcPort string) []*service.Service {
+			return servicesForPort(services[k], svcPort)
+		},
 		"getMode": func(k string) string {
 			return modes[k]
 		},
 		"getPorts": func(k string) map[string]string {
-			return ports[k]
+			return ports[k]["tcp"]
 		},
+		"getPortsByType": func(k string, portType string) map[string]string {
+			return ports[k][portType]
+		},
+		"getPortTypes": ports.typesFor,
 		"portFor":      findPortForService,
+		"portForType":  findPortForServiceByType,
 		"ipFor":        h.findIpForService,
 		"bindIP":       func() string { return h.BindIP },
 		"sanitizeName": sanitizeName,
+		"isDraining":   func(svc *service.Service) bool { return svc.IsDraining() },
+		"hasTLS": func(k string) bool {
+			return h.hasTLS(k, modes, ports)
+		},
+		"tlsEnabled": func() bool {
+			for k := range services {
+				if h.hasTLS(k, modes, ports) {
+					return true
+				}
+			}
+			return false
+		},
+		"certsFor":     h.TLS.certsFor,
+		"tlsHostnames": h.TLS.hostnamesFor,
+		"tlsPort":      h.TLS.port,
+		"primaryPort": func(k string) string {
+			return primaryPort(ports, k)
+		},
+		"hasVhost": func(k string) bool {
+			return h.hasVhost(k, modes, ports)
+		},
+		"vhostsEnabled": func() bool {
+			for k := range services {
+				if h.hasVhost(k, modes, ports) {
+					return true
+				}
+			}
+			return false
+		},
+		"vhostsFor":    h.Vhosts.hostnamesFor,
+		"vhostPort":    h.Vhosts.port,
+		"vhostMapFile": h.Vhosts.mapFile,
+		"settingsFor":  h.settingsFor,
+		"sourceFor":    h.sourceFor,
+	}
+}
+
+// The data passed to the templates
+type templateData struct {
+	Services map[string][]*service.Service
+	User     string
+	Group    string
+}
+
+// Everything the templates need for one render. All of the outputs for an
+// update share one of these so they see the same state.
+type renderContext struct {
+	data  templateData
+	funcs template.FuncMap
+}
+
+func (h *HAproxy) newRenderContext(state *catalog.ServicesState) *renderContext {
+	state.RLock()
+	services := servicesWithPorts(state)
+	ports := h.makePortmap(services)
+	modes := getModes(state)
+	state.RUnlock()
+
+	return &renderContext{
+		data: templateData{
+			Services: servicesWithAllPorts(services, ports),
+			User:     h.User,
+			Group:    h.Group,
+		},
+		funcs: h.templateFuncs(services, modes, ports),
+	}
+}
+
+// Render one template with the supplied context
+func (h *HAproxy) render(state *catalog.ServicesState, ctx *renderContext, templatePath string) ([]byte, error) {
+	t, err := h.getTemplate(templatePath)
+	if err != nil {
+		return nil, err
 	}
 
-	t, err := template.New("haproxy").Funcs(funcMap).ParseFiles(h.Template)
+	// Bind the template functions to the data for this render
+	t, err = t.Clone()
 	if err != nil {
-		return fmt.Errorf("Error Parsing template '%s': %s", h.Template, err.Error())
+		return nil, fmt.Errorf("Error cloning template '%s': %s", templatePath, err.Error())
 	}
+	t.Funcs(ctx.funcs)
 
 	// We write into a buffer so disk IO doesn't hold up the whole state lock
 	buf := bytes.NewBuffer(make([]byte, 0, 65535))
 	state.RLock()
-	err = t.ExecuteTemplate(buf, path.Base(h.Template), data)
+	err = t.ExecuteTemplate(buf, path.Base(templatePath), ctx.data)
 	state.RUnlock()
 	if err != nil {
-		return fmt.Errorf("Error executing template '%s': %s", h.Template, err.Error())
+		return nil, fmt.Errorf("Error executing template '%s': %s", templatePath, err.Error())
 	}
 
-	// This is the potentially slowest bit, do it outside the critical section
-	_, err = io.Copy(output, buf)
-	if err != nil {
-		return fmt.Errorf("Error writing template '%s': %s", h.Template, err.Error())
+	return buf.Bytes(), nil
+}
+
+// A rendered output and where it goes
+type renderedFile struct {
+	File    string
+	Content []byte
+}
+
+// Render all of the outputs from the same state. The main config is first.
+func (h *HAproxy) renderOutputs(state *catalog.ServicesState) ([]renderedFile, error) {
+	start := time.Now()
+	ctx := h.newRenderContext(state)
+
+	var rendered []renderedFile
+	for _, output := range h.outputs() {
+		content, err := h.render(state, ctx, output.Template)
+		if err != nil {
+			observeRender(start, err)
+			return nil, err
+		}
+		rendered = append(rendered, renderedFile{File: output.File, Content: content})
 	}
 
-	return nil
+	observeRender(start, nil)
+	return rendered, nil
 }
 
 // notifySignals swallows a bunch of signals that get sent to us when running into
@@ -262,59 +454,354 @@ func (h *HAproxy) run(command string) error {
 
 // Run the HAproxy reload command to load the new config and restart.
 // Best to use a command with -sf specified to keep the connections up.
+// In master-worker and supervised modes, the master is asked to reload instead.
 func (h *HAproxy) Reload() error {
-	return h.run(h.ReloadCmd)
+	start := time.Now()
+	var err error
+	switch h.Mode {
+	case ModeMasterWorker:
+		err = h.reloadMaster(h.startMaster)
+	case ModeSupervised:
+		err = h.reloadSupervised()
+	default:
+		err = h.run(h.ReloadCmd)
+	}
+	reloadDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		reloadFailuresTotal.Inc()
+		return err
+	}
+
+	reloadsTotal.Inc()
+	recordApplied()
+	return nil
 }
 
 // Run HAproxy with the verify command that will check the validity of
 // the current config. Used to gate a Reload() so we don't load a bad
 // config and tear everything down.
 func (h *HAproxy) Verify() error {
-	return h.run(h.VerifyCmd)
+	return h.verify(strings.Replace(h.VerifyCmd, ConfigPlaceholder, h.ConfigFile, -1))
+}
+
+// Run the verify command against a config file other than ConfigFile.
+func (h *HAproxy) VerifyFile(path string) error {
+	command, err := h.verifyCmdFor(path)
+	if err != nil {
+		verifyFailuresTotal.Inc()
+		return err
+	}
+
+	return h.verify(command)
+}
+
+// CheckVerifyCmd makes sure VerifyCmd says where the config to check goes,
+// so a bad one is caught at startup rather than on every update
+func (h *HAproxy) CheckVerifyCmd() error {
+	_, err := h.verifyCmdFor(h.ConfigFile + CandidateSuffix)
+	return err
+}
+
+// The verify command for the config at path. VerifyCmd has to say where the
+// config goes, either with ConfigPlaceholder or with the ConfigFile path as
+// an argument of its own, otherwise we'd be checking the live config instead
+// of the one we were given.
+func (h *HAproxy) verifyCmdFor(path string) (string, error) {
+	if strings.Contains(h.VerifyCmd, ConfigPlaceholder) {
+		return strings.Replace(h.VerifyCmd, ConfigPlaceholder, path, -1), nil
+	}
+
+	if h.ConfigFile != "" {
+		if command, ok := replaceArg(h.VerifyCmd, h.ConfigFile, path); ok {
+			return command, nil
+		}
+	}
+
+	return "", fmt.Errorf("Verify command '%s' has neither %s nor the config file '%s' as an argument, "+
+		"so it can't check new configs. Use e.g. 'haproxy -c -f %s'",
+		h.VerifyCmd, ConfigPlaceholder, h.ConfigFile, ConfigPlaceholder)
+}
+
+// Replace the whitespace separated arguments in command that are exactly
+// old, leaving alone any that only contain it. Returns false if there were
+// none.
+func replaceArg(command string, old string, new string) (string, bool) {
+	var result strings.Builder
+	replaced := false
+
+	for i := 0; i < len(command); {
+		if command[i] == ' ' || command[i] == '\t' {
+			result.WriteByte(command[i])
+			i++
+			continue
+		}
+
+		end := strings.IndexAny(command[i:], " \t")
+		if end < 0 {
+			end = len(command)
+		} else {
+			end += i
+		}
+
+		if command[i:end] == old {
+			result.WriteString(new)
+			replaced = true
+		} else {
+			result.WriteString(command[i:end])
+		}
+		i = end
+	}
+
+	return result.String(), replaced
+}
+
+func (h *HAproxy) verify(command string) error {
+	start := time.Now()
+	err := h.run(command)
+	verifyDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		verifyFailuresTotal.Inc()
+	}
+
+	return err
 }
 
 // Watch the state of a ServicesState struct and generate a new proxy
 // config file (haproxy.ConfigFile) when the state changes. Also notifies
 // the service that it needs to reload once the new file has been written
-// and verified.
+// and verified. Bursts of changes are coalesced by a Scheduler.
 func (h *HAproxy) Watch(state *catalog.ServicesState) {
 	h.eventChannel = make(chan catalog.ChangeEvent, 2)
 	state.AddListener(h)
 
-	for event := range h.eventChannel {
-		log.Println("State change event from " + event.Service.Hostname)
+	scheduler := h.NewScheduler(func(state *catalog.ServicesState) {
 		err := h.WriteAndReload(state)
 		if err != nil {
 			log.Error(err.Error())
 		}
+	})
+	go scheduler.Run(director.NewFreeLooper(director.FOREVER, nil))
+
+	for event := range h.eventChannel {
+		log.Println("State change event from " + event.Service.Hostname)
+		scheduler.Trigger(state)
 	}
 
+	scheduler.Stop()
+
 	err := state.RemoveListener(h.Name())
 	if err != nil {
 		log.Warnf("Failed to remove HAProxy listener: %s", err)
 	}
 }
 
-// Write out the the HAproxy config and reload the service.
+// Write out the the HAproxy config and reload the service. The config and any
+// extra Outputs are rendered into candidate files next to where they belong.
+// The extra outputs are moved into place first, since the main config refers
+// to them by their real paths, then the main config is verified as a
+// candidate and atomically renamed into place. The last set of files that was
+// successfully loaded is kept alongside them and restored if verification
+// or the reload fails, so a bad render never survives on disk.
+//
+// If the rendered files are the same as the ones last applied, nothing is
+// written or reloaded. When UseRuntimeApi is set and the only changes are
+// backend servers coming, going, or moving, they are applied over the stats
+// socket instead of reloading HAproxy. LastOutcome() reports which of these
+// happened.
 func (h *HAproxy) WriteAndReload(state *catalog.ServicesState) error {
 	if h.ConfigFile == "" {
 		return fmt.Errorf("Trying to write HAproxy config, but no filename specified!")
 	}
 
-	outfile, err := os.Create(h.ConfigFile)
+	h.applyLock.Lock()
+	defer h.applyLock.Unlock()
+
+	outcome, err := h.writeAndReload(state)
 	if err != nil {
-		return fmt.Errorf("Unable to write to %s! (%s)", h.ConfigFile, err.Error())
+		outcome = OutcomeFailed
 	}
+	h.lastOutcome = outcome
 
-	if err := h.WriteConfig(state, outfile); err != nil {
-		return err
+	return err
+}
+
+func (h *HAproxy) writeAndReload(state *catalog.ServicesState) (Outcome, error) {
+	rendered, err := h.renderOutputs(state)
+	if err != nil {
+		return OutcomeFailed, err
+	}
+	primary, extras := rendered[0], rendered[1:]
+	recordConfigSize(primary.Content)
+
+	hashes := make(map[string]string, len(rendered))
+	for _, file := range rendered {
+		hashes[file.File] = configHash(file.Content)
+	}
+
+	extrasChanged := false
+	for _, file := range extras {
+		extrasChanged = extrasChanged || hashes[file.File] != h.lastHashes[file.File]
+	}
+
+	// New certificates need a reload even when the config is the same
+	certsHash := h.TLS.certsHash()
+	if certsHash != h.lastCertsHash {
+		extrasChanged = true
 	}
 
-	if err = h.Verify(); err != nil {
-		return fmt.Errorf("Failed to verify HAproxy config! (%s)", err.Error())
+	if h.lastApplied != nil && !extrasChanged && hashes[primary.File] == h.lastHashes[primary.File] {
+		log.Info("HAproxy config unchanged, skipping reload")
+		reloadsSkippedTotal.Inc()
+		return OutcomeUnchanged, nil
 	}
 
-	return h.Reload()
+	// Stage everything before touching any live files
+	for _, file := range rendered {
+		if err := WriteFileAtomic(file.File+CandidateSuffix, file.Content, 0644); err != nil {
+			removeCandidates(rendered)
+			return OutcomeFailed, err
+		}
+	}
+
+	// Until HAproxy is running the new files, a failure puts back exactly
+	// what was there, which might be nothing at all on the first run. The
+	// last known good copies are only for when that doesn't work.
+	var paths []string
+	for _, file := range rendered {
+		paths = append(paths, file.File)
+	}
+	previous, err := snapshotFiles(paths)
+	if err != nil {
+		removeCandidates(rendered)
+		return OutcomeFailed, err
+	}
+
+	rollBack := func() {
+		if err := restoreFiles(previous); err != nil {
+			log.Errorf("Unable to put back the previous files! (%s)", err)
+			h.restoreLastGood(rendered)
+		}
+		removeCandidates(rendered)
+	}
+
+	// The extras go live first, since the main config refers to them
+	if err := promoteCandidates(extras); err != nil {
+		rollBack()
+		return OutcomeFailed, err
+	}
+
+	if err := h.VerifyFile(primary.File + CandidateSuffix); err != nil {
+		rollBack()
+		return OutcomeFailed, fmt.Errorf("Failed to verify HAproxy config! (%s)", err.Error())
+	}
+
+	if err := promoteCandidates(rendered[:1]); err != nil {
+		rollBack()
+		return OutcomeFailed, err
+	}
+
+	outcome, err := h.apply(primary.Content, !extrasChanged)
+	if err != nil {
+		rollBack()
+		return OutcomeFailed, err
+	}
+
+	h.previousApplied = h.lastApplied
+	h.lastApplied = primary.Content
+	h.lastHashes = hashes
+	h.lastCertsHash = certsHash
+
+	// These are now the last known good files
+	for _, file := range rendered {
+		if err := copyFileAtomic(file.File, file.File+LastGoodSuffix); err != nil {
+			log.Warnf("Unable to save last known good copy of %s: %s", file.File, err)
+		}
+	}
+
+	return outcome, nil
+}
+
+// Atomically move staged candidate files into place
+func promoteCandidates(files []renderedFile) error {
+	for _, file := range files {
+		candidate := file.File + CandidateSuffix
+		if err := os.Rename(candidate, file.File); err != nil {
+			return fmt.Errorf("Unable to move %s into place! (%s)", candidate, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Clean up any staged candidate files that are left over
+func removeCandidates(files []renderedFile) {
+	for _, file := range files {
+		os.Remove(file.File + CandidateSuffix)
+	}
+}
+
+// LastOutcome reports what the most recent WriteAndReload() did
+func (h *HAproxy) LastOutcome() Outcome {
+	h.applyLock.Lock()
+	defer h.applyLock.Unlock()
+
+	return h.lastOutcome
+}
+
+// Get HAproxy running the config that is now in ConfigFile. Uses the Runtime
+// API if we're allowed to and can, otherwise does a full reload.
+func (h *HAproxy) apply(config []byte, allowRuntime bool) (Outcome, error) {
+	if h.UseRuntimeApi && allowRuntime {
+		err := h.applyRuntimeChanges(config)
+		if err == nil {
+			log.Info("Applied changes through the HAproxy Runtime API")
+			runtimeApiUpdatesTotal.Inc()
+			recordApplied()
+			return OutcomeRuntimeApi, nil
+		}
+		log.Infof("Reloading, unable to use the HAproxy Runtime API: %s", err)
+	}
+
+	return OutcomeReloaded, h.Reload()
+}
+
+// Hash a rendered config for comparison. Comment lines are left out since
+// they don't change what HAproxy does, and the template header includes
+// the time it was rendered.
+func configHash(config []byte) string {
+	hash := sha256.New()
+
+	// Split rather than scan, since a Scanner gives up on long lines and
+	// we'd only hash part of the config
+	for _, line := range bytes.Split(config, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		hash.Write(line)
+		hash.Write([]byte("\n"))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Put the last known good copies of files back in place after a failure. If
+// we've never had a good copy of one, there is nothing to put back.
+func (h *HAproxy) restoreLastGood(files []renderedFile) {
+	for _, file := range files {
+		lastGood := file.File + LastGoodSuffix
+		if !fileExists(lastGood) {
+			log.Warnf("No last known good copy of %s to restore", file.File)
+			continue
+		}
+
+		log.Warnf("Restoring last known good %s", file.File)
+		err := copyFileAtomic(lastGood, file.File)
+		if err != nil {
+			log.Errorf("Unable to restore last known good %s! (%s)", file.File, err)
+		}
+	}
 }
 
 // Name is part of the catalog.Listener interface. Returns the listener name.
@@ -349,61 +836,54 @@ func getModes(state *catalog.ServicesState) map[string]string {
 }
 
 // Like state.ByService() but only stores information for services which
-// actually have public ports. Only matches services that have the same name
-// and the same ports. Otherwise log an error.
+// actually have public ports. Instances of a service don't all need to have
+// the same ports: each ServicePort is served by every instance that exposes
+// it. See servicesForPort() and PortGroups().
 func servicesWithPorts(state *catalog.ServicesState) map[string][]*service.Service {
 	serviceMap := make(map[string][]*service.Service)
 
+	var candidates []*service.Service
 	state.EachService(
 		func(hostname *string, serviceId *string, svc *service.Service) {
 			if len(svc.Ports) < 1 {
 				return
 			}
 
-			// We only want things that are alive and healthy!
-			if !svc.IsAlive() {
-				return
-			}
-
-			// If this is the first one, just set it
-			if _, ok := serviceMap[svc.Name]; !ok {
-				serviceMap[svc.Name] = []*service.Service{svc}
+			// We only want things that are alive and healthy, or draining.
+			// Draining services stay in the config so their connections can
+			// finish, but the template should give them no new traffic.
+			if !svc.IsAlive() && !svc.IsDraining() {
 				return
 			}
 
-			// Otherwise we need to make sure the ServicePorts match
-			match := serviceMap[svc.Name][0] // Get the first entry for comparison
-
-			// Build up a sorted list of ServicePorts from the existing service
-			portsToMatch := getSortedServicePorts(match)
-
-			// Get the list of our ports
-			portsWeHave := getSortedServicePorts(svc)
-
-			// Compare the two sorted lists
-			for i, port := range portsToMatch {
-				if portsWeHave[i] != port {
-					// TODO should we just add another service with this port added
-					// to the name? We have to find out which port.
-					log.Warnf("%s service from %s not added: non-matching ports! (%v vs %v)",
-						svc.Name, svc.Hostname, port, portsWeHave[i])
-					return
-				}
-			}
-
-			// It was a match! Append to the list.
-			serviceMap[svc.Name] = append(serviceMap[svc.Name], svc)
+			candidates = append(candidates, svc)
 		},
 	)
 
+	// EachService() walks a map, so sort to make sure the same state always
+	// renders the same config.
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Hostname != candidates[j].Hostname {
+			return candidates[i].Hostname < candidates[j].Hostname
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	for _, svc := range candidates {
+		serviceMap[svc.Name] = append(serviceMap[svc.Name], svc)
+	}
+
 	return serviceMap
 }
 
+// Returns the sorted list of exported ServicePorts for a service
 func getSortedServicePorts(svc *service.Service) []string {
-	// Allocate once, with exact length
-	portList := make([]string, len(svc.Ports))
-	for i, port := range svc.Ports {
-		portList[i] = strconv.FormatInt(port.ServicePort, 10)
+	portList := make([]string, 0, len(svc.Ports))
+	for _, port := range svc.Ports {
+		if port.ServicePort == 0 {
+			continue
+		}
+		portList = append(portList, strconv.FormatInt(port.ServicePort, 10))
 	}
 
 	sort.Strings(portList)
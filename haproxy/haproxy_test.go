@@ -6,11 +6,14 @@ import (
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/service"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -114,8 +117,29 @@ func Test_HAproxy(t *testing.T) {
 			result := proxy.makePortmap(state.ByService())
 
 			So(len(result), ShouldEqual, 3)
-			So(len(result[services[0].Image]), ShouldEqual, 2)
-			So(len(result[services[2].Image]), ShouldEqual, 1)
+			So(len(result[services[0].Image]["tcp"]), ShouldEqual, 2)
+			So(len(result[services[2].Image]["tcp"]), ShouldEqual, 1)
+		})
+
+		Convey("makePortmap() keeps ports of other types separate", func() {
+			dnsSvc := &service.Service{
+				ID:       "deadbeef053",
+				Name:     "dns-svc",
+				Hostname: hostname1,
+				Ports: []service.Port{
+					{Type: "udp", Port: 32769, ServicePort: 53, IP: ip},
+					{Type: "tcp", Port: 32768, ServicePort: 53, IP: ip},
+					{Type: "udp", Port: 32770, ServicePort: 0, IP: ip},
+				},
+			}
+			result := proxy.makePortmap(map[string][]*service.Service{"dns-svc": {dnsSvc}})
+
+			So(result["dns-svc"]["udp"], ShouldResemble, portset{"53": "32769"})
+			So(result["dns-svc"]["tcp"], ShouldResemble, portset{"53": "32768"})
+			So(result.typesFor("dns-svc"), ShouldResemble, []string{"tcp", "udp"})
+
+			So(findPortForService("53", dnsSvc), ShouldEqual, "32768")
+			So(findPortForServiceByType("53", "udp", dnsSvc), ShouldEqual, "32769")
 		})
 
 		Convey("getModes() generates a correct mode map", func() {
@@ -159,11 +183,61 @@ func Test_HAproxy(t *testing.T) {
 			svcList := servicesWithPorts(state)
 			So(len(svcList[badSvc.Name]), ShouldEqual, 1)
 
-			// We add an entry with mismatching ports and should get no more added
+			// We add an entry with mismatching ports and it is still kept
 			state.AddServiceEntry(badSvc)
 
 			svcList = servicesWithPorts(state)
-			So(len(svcList[badSvc.Name]), ShouldEqual, 1)
+			So(len(svcList[badSvc.Name]), ShouldEqual, 2)
+
+			Convey("and servicesForPort() picks the instances exposing a port", func() {
+				So(servicesForPort(svcList[badSvc.Name], "8090")[0].ID, ShouldEqual, svcId3)
+				So(servicesForPort(svcList[badSvc.Name], "6666")[0].ID, ShouldEqual, badSvc.ID)
+				So(len(servicesForPort(svcList[badSvc.Name], "8090")), ShouldEqual, 1)
+			})
+
+			Convey("and PortGroups() reports how they were grouped", func() {
+				groups := PortGroups(state)
+
+				So(len(groups["some-svc"]), ShouldEqual, 2)
+				So(groups["some-svc"][0].Ports, ShouldResemble, []string{"8090"})
+				So(groups["some-svc"][0].Instances, ShouldResemble, []PortGroupItem{{Hostname: hostname2, ID: svcId3}})
+				So(groups["some-svc"][1].Ports, ShouldResemble, []string{"6666"})
+				So(groups["some-svc"][1].Instances, ShouldResemble, []PortGroupItem{{Hostname: "titanic", ID: badSvc.ID}})
+				So(len(groups["awesome-svc"]), ShouldEqual, 1)
+			})
+
+			Convey("and WriteConfig() puts each instance in the right backends", func() {
+				buf := bytes.NewBuffer(make([]byte, 0, 2048))
+				err := proxy.WriteConfig(state, buf)
+
+				So(err, ShouldBeNil)
+				So(buf.Bytes(), ShouldMatch, "backend some-svc-6666\n(?:\t.*\n)*\tserver titanic-0000bad00000 127.0.0.1:666 ")
+				So(buf.Bytes(), ShouldMatch, "backend some-svc-8090\n(?:\t.*\n)*\tserver indefatigable-deadbeef105 127.0.0.3:9999 ")
+				So(buf.Bytes(), ShouldNotMatch, ":-1 ")
+			})
+
+			Convey("and templates that range over all of a service's instances still work", func() {
+				tmpDir, _ := ioutil.TempDir("", "oldTemplate")
+				defer os.RemoveAll(tmpDir)
+
+				// The backends from before servicesFor existed
+				ioutil.WriteFile(tmpDir+"/old.cfg", []byte(
+					"{{ range $svcName, $services := .Services }}{{ range $svcPort, $port := getPorts $svcName }}\n"+
+						"backend {{ $svcName }}-{{ $svcPort }}{{ range $svc := $services }}\n"+
+						"\tserver {{ $svc.Hostname }}-{{ $svc.ID }} {{ ipFor $svcPort $svc }}:{{ portFor $svcPort $svc }}{{ end }}\n"+
+						"{{ end }}{{ end }}",
+				), 0644)
+				proxy.Template = tmpDir + "/old.cfg"
+
+				buf := bytes.NewBuffer(make([]byte, 0, 2048))
+				err := proxy.WriteConfig(state, buf)
+
+				So(err, ShouldBeNil)
+				So(buf.Bytes(), ShouldMatch, "backend some-svc-6666\n")
+				So(buf.Bytes(), ShouldMatch, "backend some-svc-8090\n")
+				So(buf.Bytes(), ShouldMatch, "\tserver indefatigable-deadbeef101 127.0.0.3:32763")
+				So(buf.Bytes(), ShouldNotMatch, ":-1")
+			})
 		})
 
 		Convey("WriteConfig() writes a template from a file", func() {
@@ -192,6 +266,221 @@ func Test_HAproxy(t *testing.T) {
 			So(err, ShouldNotBeNil)
 		})
 
+		Convey("LoadTemplate() keeps the previous template when the new one is broken", func() {
+			tmpDir, _ := ioutil.TempDir("", "LoadTemplate")
+			proxy.Template = tmpDir + "/haproxy.cfg"
+			ioutil.WriteFile(proxy.Template, []byte("bind {{ bindIP }}\n"), 0644)
+
+			So(proxy.LoadTemplate(), ShouldBeNil)
+
+			ioutil.WriteFile(proxy.Template, []byte("bind {{ bindIP \n"), 0644)
+			err := proxy.LoadTemplate()
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			renderErr := proxy.WriteConfig(state, buf)
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldNotBeNil)
+			So(renderErr, ShouldBeNil)
+			So(buf.String(), ShouldEqual, "bind 192.168.168.168\n")
+		})
+
+		Convey("WatchTemplate() reloads the template when it changes on disk", func() {
+			tmpDir, _ := ioutil.TempDir("", "WatchTemplate")
+			proxy.Template = tmpDir + "/haproxy.cfg"
+			ioutil.WriteFile(proxy.Template, []byte("old\n"), 0644)
+			So(proxy.LoadTemplate(), ShouldBeNil)
+
+			ioutil.WriteFile(proxy.Template, []byte("new\n"), 0644)
+			later := time.Now().Add(1 * time.Minute)
+			os.Chtimes(proxy.Template, later, later)
+
+			var changed bool
+			proxy.WatchTemplate(director.NewFreeLooper(director.ONCE, nil), func() { changed = true })
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+			os.RemoveAll(tmpDir)
+
+			So(changed, ShouldBeTrue)
+			So(buf.String(), ShouldEqual, "new\n")
+		})
+
+		Convey("WriteConfig() adds an HTTPS frontend for services with certs", func() {
+			certDir, _ := ioutil.TempDir("", "certs")
+			defer os.RemoveAll(certDir)
+			ioutil.WriteFile(certDir+"/awesome.example.com.pem", []byte("cert"), 0644)
+
+			proxy.TLS = &TLSConfig{
+				CertDir: certDir,
+				Services: map[string][]string{
+					"awesome-svc": {"awesome.example.com", "www.awesome.example.com"},
+					"some-svc":    {"some.example.com"}, // No cert for this one
+				},
+			}
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, ":443 ssl crt "+certDir+"/awesome.example.com.pem\n")
+			So(output, ShouldContainSubstring,
+				"use_backend awesome-svc-8080 if { ssl_fc_sni -i awesome.example.com www.awesome.example.com }")
+			So(output, ShouldNotContainSubstring, "-i some.example.com")
+
+			Convey("and reloads when a certificate changes", func() {
+				tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+				defer os.RemoveAll(tmpDir)
+				proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+				proxy.VerifyCmd = "/usr/bin/true {{config}}"
+				proxy.ReloadCmd = "/usr/bin/true"
+
+				So(proxy.WriteAndReload(state), ShouldBeNil)
+				So(proxy.WriteAndReload(state), ShouldBeNil)
+				So(proxy.LastOutcome(), ShouldEqual, OutcomeUnchanged)
+
+				ioutil.WriteFile(certDir+"/awesome.example.com.pem", []byte("renewed"), 0644)
+				So(proxy.WriteAndReload(state), ShouldBeNil)
+				So(proxy.LastOutcome(), ShouldEqual, OutcomeReloaded)
+			})
+		})
+
+		Convey("WriteConfig() leaves out HTTPS when no service has a cert", func() {
+			proxy.TLS = &TLSConfig{
+				CertDir:  "/does/not/exist",
+				Services: map[string][]string{"awesome-svc": {"awesome.example.com"}},
+			}
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldNotContainSubstring, "frontend https")
+		})
+
+		Convey("WriteConfig() routes virtual hosts with ACLs", func() {
+			proxy.Vhosts = &VhostsConfig{
+				Services: map[string][]string{"awesome-svc": {"Awesome.example.com", "awesome.local"}},
+			}
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "frontend http-vhosts")
+			So(output, ShouldContainSubstring, ":80\n")
+			So(output, ShouldContainSubstring,
+				"acl host-awesome-svc req.hdr(host),lower,field(1,:) -i awesome.example.com awesome.local\n")
+			So(output, ShouldContainSubstring, "use_backend awesome-svc-8080 if host-awesome-svc\n")
+		})
+
+		Convey("WriteAndReload() routes virtual hosts with a map file", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			defer os.RemoveAll(tmpDir)
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "/usr/bin/true {{config}}"
+			proxy.ReloadCmd = "/usr/bin/true"
+			proxy.Vhosts = &VhostsConfig{
+				BindPort:    8888,
+				MapFile:     tmpDir + "/hosts.map",
+				MapTemplate: "../templates/hosts.map",
+				Services:    map[string][]string{"awesome-svc": {"awesome.example.com"}},
+			}
+
+			err := proxy.WriteAndReload(state)
+			config, _ := ioutil.ReadFile(proxy.ConfigFile)
+			hostsMap, _ := ioutil.ReadFile(tmpDir + "/hosts.map")
+
+			So(err, ShouldBeNil)
+			So(string(config), ShouldContainSubstring, ":8888\n")
+			So(string(config), ShouldContainSubstring,
+				"use_backend %[req.hdr(host),lower,field(1,:),map("+tmpDir+"/hosts.map)]")
+			So(string(hostsMap), ShouldEndWith, "awesome.example.com awesome-svc-8080\n")
+		})
+
+		Convey("LoadOverrides() applies per-service settings", func() {
+			tmpDir, _ := ioutil.TempDir("", "overrides")
+			defer os.RemoveAll(tmpDir)
+			proxy.OverridesFile = tmpDir + "/overrides.toml"
+			ioutil.WriteFile(proxy.OverridesFile, []byte(
+				"[defaults]\ntimeout_server = \"2m\"\n\n"+
+					"[services.awesome-svc]\nbalance = \"leastconn\"\ntimeout_server = \"30m\"\n",
+			), 0644)
+
+			So(proxy.LoadOverrides(), ShouldBeNil)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+
+			So(buf.Bytes(), ShouldMatch, "backend awesome-svc-8080\n.*\n\tbalance leastconn\n\ttimeout connect 5s\n\ttimeout server 30m\n")
+			So(buf.Bytes(), ShouldMatch, "backend some-svc-8090\n.*\n\tbalance roundrobin\n\ttimeout connect 5s\n\ttimeout server 2m\n")
+			So(buf.Bytes(), ShouldMatch, "frontend awesome-svc-8080\n(?:\t.*\n)*\tmaxconn 4096\n")
+
+			Convey("and keeps them when the file is broken", func() {
+				ioutil.WriteFile(proxy.OverridesFile, []byte("[services.awesome-svc]\nbalence = \"first\"\n"), 0644)
+
+				So(proxy.LoadOverrides(), ShouldNotBeNil)
+				So(proxy.settingsFor("awesome-svc").Balance, ShouldEqual, "leastconn")
+			})
+		})
+
+		Convey("WriteConfig() adds health checks to servers", func() {
+			proxy.HealthCheck = HealthCheck{Type: "tcp", Interval: "5s"}
+			tmpDir, _ := ioutil.TempDir("", "overrides")
+			defer os.RemoveAll(tmpDir)
+			proxy.OverridesFile = tmpDir + "/overrides.toml"
+			ioutil.WriteFile(proxy.OverridesFile, []byte(
+				"[services.awesome-svc.health_check]\ntype = \"http\"\npath = \"/status\"\nfall = 5\n\n"+
+					"[services.some-svc.health_check]\ntype = \"none\"\n",
+			), 0644)
+			So(proxy.LoadOverrides(), ShouldBeNil)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+
+			So(buf.Bytes(), ShouldMatch, "backend awesome-svc-8080\n(?:\t.*\n)*\toption httpchk GET /status\n\thttp-check expect status 200\n")
+			So(buf.Bytes(), ShouldMatch, "server indomitable-deadbeef123 .* check inter 5s rise 2 fall 5")
+			So(buf.String(), ShouldNotContainSubstring, "option httpchk GET /\n")
+			So(buf.Bytes(), ShouldNotMatch, "backend some-svc-8090\n(?:\t.*\n)*\tserver .* check ")
+
+			Convey("and leaves them off by default", func() {
+				proxy.HealthCheck = HealthCheck{}
+				proxy.OverridesFile = ""
+				proxy.overrides = nil
+
+				buf.Reset()
+				err := proxy.WriteConfig(state, buf)
+				So(err, ShouldBeNil)
+				So(buf.String(), ShouldNotContainSubstring, " check ")
+				So(buf.String(), ShouldNotContainSubstring, "httpchk")
+			})
+		})
+
+		Convey("WriteConfig() keeps draining services with no weight", func() {
+			drainingSvc := service.Service{
+				ID:       "00000drain00",
+				Name:     "some-svc-0155555789a",
+				Image:    "some-svc",
+				Hostname: "titanic",
+				Status:   service.DRAINING,
+				Updated:  baseTime.Add(5 * time.Second),
+				Ports: []service.Port{
+					{Type: "tcp", Port: 667, ServicePort: 8090, IP: "127.0.0.1"},
+				},
+			}
+			state.AddServiceEntry(drainingSvc)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+
+			So(buf.String(), ShouldContainSubstring,
+				"server titanic-00000drain00 127.0.0.1:667 cookie titanic-667 weight 0")
+		})
+
 		Convey("WriteConfig() only writes out healthy services", func() {
 			badSvc := service.Service{
 				ID:       "0000bad00000",
@@ -256,6 +545,240 @@ func Test_HAproxy(t *testing.T) {
 
 		})
 
+		Convey("WriteAndReload() leaves the live config alone when verify fails", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "/usr/bin/false " + proxy.ConfigFile
+			proxy.ReloadCmd = "/usr/bin/true"
+			ioutil.WriteFile(proxy.ConfigFile, []byte("good config"), 0644)
+
+			err := proxy.WriteAndReload(state)
+			result, _ := ioutil.ReadFile(proxy.ConfigFile)
+			_, statErr := os.Stat(proxy.ConfigFile + CandidateSuffix)
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldNotBeNil)
+			So(string(result), ShouldEqual, "good config")
+			So(os.IsNotExist(statErr), ShouldBeTrue)
+		})
+
+		Convey("verifyCmdFor() only replaces the config file as a whole argument", func() {
+			proxy.ConfigFile = "/tmp/haproxy.cfg"
+			proxy.VerifyCmd = "check --map /tmp/haproxy.cfg.map  -f /tmp/haproxy.cfg"
+
+			command, err := proxy.verifyCmdFor("/tmp/candidate.cfg")
+			So(err, ShouldBeNil)
+			So(command, ShouldEqual, "check --map /tmp/haproxy.cfg.map  -f /tmp/candidate.cfg")
+			So(proxy.CheckVerifyCmd(), ShouldBeNil)
+
+			proxy.VerifyCmd = "check --map /tmp/haproxy.cfg.map"
+			So(proxy.CheckVerifyCmd(), ShouldNotBeNil)
+		})
+
+		Convey("WriteAndReload() verifies the candidate rather than the live config", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.ReloadCmd = "/usr/bin/true"
+			ioutil.WriteFile(proxy.ConfigFile, []byte("good config"), 0644)
+
+			Convey("with the placeholder", func() {
+				// Only the live config passes this one
+				proxy.VerifyCmd = "grep -q 'good config' {{config}}"
+				err := proxy.WriteAndReload(state)
+				result, _ := ioutil.ReadFile(proxy.ConfigFile)
+				os.RemoveAll(tmpDir)
+
+				So(err, ShouldNotBeNil)
+				So(string(result), ShouldEqual, "good config")
+			})
+
+			Convey("and passes a good candidate", func() {
+				proxy.VerifyCmd = "grep -q 'frontend awesome-svc-8080' {{config}}"
+				err := proxy.WriteAndReload(state)
+				result, _ := ioutil.ReadFile(proxy.ConfigFile)
+				os.RemoveAll(tmpDir)
+
+				So(err, ShouldBeNil)
+				So(string(result), ShouldContainSubstring, "frontend awesome-svc-8080")
+			})
+
+			Convey("and refuses a verify command that doesn't refer to the config", func() {
+				proxy.VerifyCmd = "/usr/bin/true"
+				err := proxy.WriteAndReload(state)
+				result, _ := ioutil.ReadFile(proxy.ConfigFile)
+				os.RemoveAll(tmpDir)
+
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "{{config}}")
+				So(string(result), ShouldEqual, "good config")
+			})
+		})
+
+		Convey("WriteAndReload() restores the last good config when reload fails", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "/usr/bin/true " + proxy.ConfigFile
+			proxy.ReloadCmd = "/usr/bin/true"
+
+			err := proxy.WriteAndReload(state)
+			So(err, ShouldBeNil)
+			good, _ := ioutil.ReadFile(proxy.ConfigFile)
+			lastGood, _ := ioutil.ReadFile(proxy.ConfigFile + LastGoodSuffix)
+			So(lastGood, ShouldResemble, good)
+
+			proxy.ReloadCmd = "/usr/bin/false"
+			state.AddServiceEntry(service.Service{
+				ID:       "abcdef123123126",
+				Name:     "some-new-svc",
+				Image:    "some-new-svc",
+				Hostname: hostname2,
+				Updated:  time.Now().UTC(),
+				Ports: []service.Port{
+					{Type: "tcp", Port: 1338, ServicePort: 8099, IP: "127.0.0.1"},
+				},
+			})
+
+			err = proxy.WriteAndReload(state)
+			result, _ := ioutil.ReadFile(proxy.ConfigFile)
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldNotBeNil)
+			So(result, ShouldResemble, good)
+		})
+
+		Convey("WriteAndReload() writes extra outputs along with the config", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "test -f " + tmpDir + "/services.map && test -f " + proxy.ConfigFile
+			proxy.ReloadCmd = "/usr/bin/true"
+			ioutil.WriteFile(tmpDir+"/services.tmpl", []byte("{{ range $name, $svcs := .Services }}{{ $name }}\n{{ end }}"), 0644)
+			proxy.Outputs = []Output{{Template: tmpDir + "/services.tmpl", File: tmpDir + "/services.map"}}
+
+			err := proxy.WriteAndReload(state)
+			services, _ := ioutil.ReadFile(tmpDir + "/services.map")
+			config, _ := ioutil.ReadFile(proxy.ConfigFile)
+			lastGood, _ := ioutil.ReadFile(tmpDir + "/services.map" + LastGoodSuffix)
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldBeNil)
+			So(string(services), ShouldEqual, "awesome-svc\nsome-svc\nsome-websock-svc\n")
+			So(config, ShouldMatch, "frontend awesome-svc-8080")
+			So(lastGood, ShouldResemble, services)
+		})
+
+		Convey("WriteAndReload() rolls back everything when the first reload fails", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "/usr/bin/true {{config}}"
+			proxy.ReloadCmd = "/usr/bin/false"
+			ioutil.WriteFile(tmpDir+"/services.tmpl", []byte("{{ range $name, $svcs := .Services }}{{ $name }}\n{{ end }}"), 0644)
+			proxy.Outputs = []Output{{Template: tmpDir + "/services.tmpl", File: tmpDir + "/services.map"}}
+
+			err := proxy.WriteAndReload(state)
+			_, configErr := os.Stat(proxy.ConfigFile)
+			_, mapErr := os.Stat(tmpDir + "/services.map")
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldNotBeNil)
+			So(os.IsNotExist(configErr), ShouldBeTrue)
+			So(os.IsNotExist(mapErr), ShouldBeTrue)
+		})
+
+		Convey("WriteAndReload() rolls back extra outputs when verify fails", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "/usr/bin/false {{config}}"
+			proxy.ReloadCmd = "/usr/bin/true"
+			ioutil.WriteFile(tmpDir+"/services.tmpl", []byte("{{ range $name, $svcs := .Services }}{{ $name }}\n{{ end }}"), 0644)
+			proxy.Outputs = []Output{
+				{Template: tmpDir + "/services.tmpl", File: tmpDir + "/services.map"},
+				{Template: tmpDir + "/services.tmpl", File: tmpDir + "/existing.map"},
+			}
+			ioutil.WriteFile(tmpDir+"/existing.map", []byte("hand written\n"), 0644)
+
+			err := proxy.WriteAndReload(state)
+			existing, _ := ioutil.ReadFile(tmpDir + "/existing.map")
+			_, statErr := os.Stat(tmpDir + "/services.map")
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldNotBeNil)
+			So(string(existing), ShouldEqual, "hand written\n")
+			So(os.IsNotExist(statErr), ShouldBeTrue)
+		})
+
+		Convey("WriteAndReload() skips the reload when the config is unchanged", func() {
+			tmpDir, _ := ioutil.TempDir("", "WriteAndReload")
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "/usr/bin/true {{config}}"
+			proxy.ReloadCmd = "echo reloaded >> " + tmpDir + "/reloads"
+
+			err := proxy.WriteAndReload(state)
+			So(err, ShouldBeNil)
+			So(proxy.LastOutcome(), ShouldEqual, OutcomeReloaded)
+
+			// The header timestamp will differ, but nothing else does
+			err = proxy.WriteAndReload(state)
+			reloads, _ := ioutil.ReadFile(tmpDir + "/reloads")
+			os.RemoveAll(tmpDir)
+
+			So(err, ShouldBeNil)
+			So(proxy.LastOutcome(), ShouldEqual, OutcomeUnchanged)
+			So(string(reloads), ShouldEqual, "reloaded\n")
+		})
+
+		Convey("ConfigDiff() diffs the last two applied configs", func() {
+			_, err := proxy.ConfigDiff()
+			So(err, ShouldNotBeNil)
+
+			proxy.previousApplied = []byte("global\n\tdaemon\nbackend a\n\tserver a1 10.0.0.1:80\n")
+			proxy.lastApplied = []byte("global\n\tdaemon\nbackend a\n\tserver a2 10.0.0.2:80\n")
+
+			diff, err := proxy.ConfigDiff()
+			So(err, ShouldBeNil)
+			So(diff, ShouldContainSubstring, "--- previous\n+++ current\n")
+			So(diff, ShouldContainSubstring, "-\tserver a1 10.0.0.1:80\n+\tserver a2 10.0.0.2:80\n")
+
+			config, err := proxy.CurrentConfig()
+			So(err, ShouldBeNil)
+			So(config, ShouldResemble, proxy.lastApplied)
+		})
+
+		Convey("configHash() ignores comments", func() {
+			config1 := []byte("# Generated at 12:00\nglobal\n\tdaemon\n")
+			config2 := []byte("# Generated at 12:01\nglobal\n\tdaemon\n")
+			config3 := []byte("# Generated at 12:01\nglobal\n\tmaxconn 10\n")
+
+			So(configHash(config1), ShouldEqual, configHash(config2))
+			So(configHash(config1), ShouldNotEqual, configHash(config3))
+		})
+
+		Convey("configHash() covers lines past a long one", func() {
+			long := "\tbind :443 ssl" + strings.Repeat(" crt /etc/haproxy/certs/some-host.example.com.pem", 2000) + "\n"
+			config1 := []byte("global\n" + long + "\tdaemon\n")
+			config2 := []byte("global\n" + long + "\tmaxconn 10\n")
+
+			So(configHash(config1), ShouldNotEqual, configHash(config2))
+		})
+
+		Convey("Preview() leaves the render metrics alone", func() {
+			proxy.VerifyCmd = "/usr/bin/true {{config}}"
+			renders := testutil.ToFloat64(rendersTotal)
+
+			preview, err := proxy.Preview(state)
+
+			So(err, ShouldBeNil)
+			So(preview.Config, ShouldContainSubstring, "frontend awesome-svc-8080")
+			So(testutil.ToFloat64(rendersTotal), ShouldEqual, renders)
+		})
+
+		Convey("recordConfigSize() counts what was rendered", func() {
+			recordConfigSize([]byte(baseConfig))
+
+			So(testutil.ToFloat64(renderedFrontends), ShouldEqual, 1)
+			So(testutil.ToFloat64(renderedBackends), ShouldEqual, 1)
+			So(testutil.ToFloat64(renderedServers), ShouldEqual, 2)
+		})
+
 		Convey("sanitizeName() fixes crazy image names", func() {
 			image := "public/something-longish:latest"
 			So(sanitizeName(image), ShouldEqual, "public-something-longish-latest")
@@ -265,7 +788,8 @@ func Test_HAproxy(t *testing.T) {
 			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
 			config := fmt.Sprintf("%s/haproxy.cfg", tmpDir)
 			proxy.ConfigFile = config
-			proxy.ReloadCmd = "/usr/bin/false"
+			proxy.VerifyCmd = "/usr/bin/true {{config}}"
+			proxy.ReloadCmd = "/usr/bin/true"
 
 			go proxy.Watch(state)
 			newTime := time.Now().UTC()
@@ -319,8 +843,7 @@ func Test_HAproxy(t *testing.T) {
 			result, _ := ioutil.ReadFile(config)
 			So(result, ShouldMatch, "port 8090")
 
-			os.Remove(config)
-			os.Remove(tmpDir)
+			os.RemoveAll(tmpDir)
 		})
 	})
 }
@@ -0,0 +1,118 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Nitro/haproxy-api/haproxy/runtime"
+)
+
+const (
+	HealthSocketTimeout = 2 * time.Second
+)
+
+// Where to look up process command lines. Replaced in tests.
+var procDir = "/proc"
+
+// CheckRunning confirms that the process in PidFile, or the one we are
+// supervising, is alive and is actually HAproxy, without shelling out. When
+// HealthCheckSocket is set, it also asks the stats socket for "show info" to
+// make sure HAproxy is answering.
+func (h *HAproxy) CheckRunning() error {
+	pid, err := h.runningPid()
+	if err != nil {
+		return err
+	}
+
+	err = checkProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	if !h.HealthCheckSocket {
+		return nil
+	}
+
+	client := runtime.NewClient(h.StatsSocket)
+	client.Timeout = HealthSocketTimeout
+	_, err = client.ShowInfo()
+	if err != nil {
+		return fmt.Errorf("HAproxy is not answering on the stats socket: %s", err)
+	}
+
+	return nil
+}
+
+// The pid of HAproxy, from the supervisor when we own the process and from
+// the pid file otherwise
+func (h *HAproxy) runningPid() (int, error) {
+	if h.Mode != ModeSupervised {
+		return readPidFile(h.PidFile)
+	}
+
+	status := h.SupervisorStatus()
+	if status == nil {
+		return 0, fmt.Errorf("HAproxy has not been started yet")
+	}
+
+	if !status.Running {
+		return 0, fmt.Errorf("HAproxy exited (%s) and is being restarted, %d restarts so far",
+			status.LastExit, status.Restarts)
+	}
+
+	return status.Pid, nil
+}
+
+// Read the pid from a pid file. When HAproxy writes more than one, the first
+// is the one we care about.
+func readPidFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read pid file: %s", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 1 {
+		return 0, fmt.Errorf("Pid file %s is empty", path)
+	}
+
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid < 1 {
+		return 0, fmt.Errorf("Pid file %s has an invalid pid '%s'", path, fields[0])
+	}
+
+	return pid, nil
+}
+
+// Make sure the process exists and that its command is HAproxy, so that a
+// stale pid file pointing at a recycled pid doesn't look healthy
+func checkProcess(pid int) error {
+	// Signal 0 does nothing but tell us if the process is there. EPERM
+	// means it is, but it belongs to someone else.
+	err := syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return fmt.Errorf("Process %d is not running: %s", pid, err)
+	}
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		// No /proc on this system, so we can't check any further
+		if _, statErr := os.Stat(procDir); statErr != nil {
+			return nil
+		}
+		return fmt.Errorf("Unable to read command for process %d: %s", pid, err)
+	}
+
+	command := strings.SplitN(string(cmdline), "\x00", 2)[0]
+	if !strings.Contains(filepath.Base(command), "haproxy") {
+		return fmt.Errorf("Process %d is '%s', not HAproxy", pid, command)
+	}
+
+	return nil
+}
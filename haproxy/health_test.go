@@ -0,0 +1,67 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_CheckRunning(t *testing.T) {
+	Convey("CheckRunning()", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "CheckRunning")
+		pid := strconv.Itoa(os.Getpid())
+
+		// Pretend our own process is HAproxy
+		oldProcDir := procDir
+		procDir = tmpDir + "/proc"
+		os.MkdirAll(filepath.Join(procDir, pid), 0755)
+		ioutil.WriteFile(filepath.Join(procDir, pid, "cmdline"), []byte("/usr/sbin/haproxy\x00-f\x00/etc/haproxy.cfg\x00"), 0644)
+
+		proxy := New(tmpDir+"/haproxy.cfg", tmpDir+"/haproxy.pid")
+		proxy.StatsSocket = tmpDir + "/haproxy.sock"
+		ioutil.WriteFile(proxy.PidFile, []byte(pid+"\n"), 0644)
+
+		Reset(func() {
+			procDir = oldProcDir
+			os.RemoveAll(tmpDir)
+		})
+
+		Convey("succeeds when the pid is a running HAproxy", func() {
+			So(proxy.CheckRunning(), ShouldBeNil)
+		})
+
+		Convey("fails when there is no pid file", func() {
+			os.Remove(proxy.PidFile)
+			So(proxy.CheckRunning(), ShouldNotBeNil)
+		})
+
+		Convey("fails when the process is gone", func() {
+			cmd := exec.Command("/usr/bin/true")
+			cmd.Run()
+			ioutil.WriteFile(proxy.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+
+			So(proxy.CheckRunning(), ShouldNotBeNil)
+		})
+
+		Convey("fails when the process isn't HAproxy", func() {
+			ioutil.WriteFile(filepath.Join(procDir, pid, "cmdline"), []byte("/bin/sleep\x00100\x00"), 0644)
+
+			err := proxy.CheckRunning()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not HAproxy")
+		})
+
+		Convey("checks the stats socket when asked to", func() {
+			proxy.HealthCheckSocket = true
+
+			err := proxy.CheckRunning()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "stats socket")
+		})
+	})
+}
@@ -0,0 +1,182 @@
+package haproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Nitro/haproxy-api/haproxy/runtime"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// How HAproxy is run and reloaded
+const (
+	ModeDaemon       = "daemon"
+	ModeMasterWorker = "master-worker"
+	ModeSupervised   = "supervised"
+)
+
+const (
+	DefaultMasterSocket  = "/var/run/haproxy_master.sock"
+	MasterReloadTimeout  = 30 * time.Second
+	MasterReloadInterval = 250 * time.Millisecond
+)
+
+// DefaultReloadCmd returns the reload command to use when none is configured.
+// In daemon mode this starts a new HAproxy that takes over from the old one
+// with -sf. In master-worker mode it is only used to start the master the
+// first time, and reloads then go over the master CLI. In supervised mode it
+// runs the master in the foreground as our child.
+func (h *HAproxy) DefaultReloadCmd() string {
+	switch h.Mode {
+	case ModeMasterWorker:
+		return "haproxy -W -D -S " + h.MasterSocket + " -f " + h.ConfigFile + " -p " + h.PidFile
+	case ModeSupervised:
+		return "haproxy -W -db -S " + h.MasterSocket + " -f " + h.ConfigFile + " -p " + h.PidFile
+	}
+
+	return "haproxy -f " + h.ConfigFile + " -p " + h.PidFile + " `[[ -f " + h.PidFile +
+		" ]] && echo \"-sf $(cat " + h.PidFile + ")\"`"
+}
+
+// Reload a master-worker HAproxy by sending "reload" to the master CLI and
+// confirming from "show proc" that it happened. If no master is answering
+// yet, fallback is called instead.
+func (h *HAproxy) reloadMaster(fallback func() error) error {
+	client := runtime.NewClient(h.MasterSocket)
+
+	procs, err := client.ShowProc()
+	if err != nil {
+		log.Infof("No HAproxy master answering on %s (%s)", h.MasterSocket, err)
+		return fallback()
+	}
+
+	before := runtime.Master(procs)
+	if before == nil {
+		return fmt.Errorf("No master process listed by HAproxy on %s", h.MasterSocket)
+	}
+
+	// HAproxy 2.7+ doesn't answer "reload" until the new worker is up, so
+	// that can take much longer than anything else we ask the master
+	timeout := client.Timeout
+	client.Timeout = MasterReloadTimeout
+	status, err := client.Reload()
+	client.Timeout = timeout
+	if err != nil {
+		return fmt.Errorf("Unable to reload HAproxy master: %s", err)
+	}
+
+	if status.Reported && !status.Success {
+		return fmt.Errorf("HAproxy master failed to reload:\n%s", status.Output)
+	}
+
+	procs, err = h.waitForMasterReload(client, before)
+	if err != nil {
+		return err
+	}
+
+	logWorkers(procs)
+	return nil
+}
+
+// Start a master with the ReloadCmd, it daemonizes itself
+func (h *HAproxy) startMaster() error {
+	log.Info("Starting HAproxy master")
+	return h.run(h.ReloadCmd)
+}
+
+// Reload the HAproxy we are supervising, starting it the first time. It is
+// reloaded through the master CLI when that is answering, and by signalling
+// it otherwise.
+func (h *HAproxy) reloadSupervised() error {
+	h.supervisorLock.Lock()
+	if h.supervisor == nil {
+		defer h.supervisorLock.Unlock()
+		// Only keep it once it's running, so the next reload tries again
+		supervisor := NewSupervisor(h.ReloadCmd)
+		err := supervisor.Start(director.NewFreeLooper(director.FOREVER, nil))
+		if err != nil {
+			return err
+		}
+		h.supervisor = supervisor
+		return nil
+	}
+	supervisor := h.supervisor
+	h.supervisorLock.Unlock()
+
+	return h.reloadMaster(supervisor.Reload)
+}
+
+// SupervisorStatus reports on the HAproxy process in supervised mode. It
+// returns nil in other modes, or before HAproxy has been started.
+func (h *HAproxy) SupervisorStatus() *SupervisorStatus {
+	h.supervisorLock.Lock()
+	defer h.supervisorLock.Unlock()
+
+	if h.supervisor == nil {
+		return nil
+	}
+
+	return h.supervisor.Status()
+}
+
+// Poll "show proc" until the master's reload count goes up. Older versions
+// of HAproxy don't report whether the reload worked, so this is how we find
+// out, and the master may take a moment to come back after re-executing.
+func (h *HAproxy) waitForMasterReload(client *runtime.Client, before *runtime.Proc) ([]runtime.Proc, error) {
+	deadline := time.Now().Add(MasterReloadTimeout)
+
+	for {
+		procs, err := client.ShowProc()
+		if err == nil {
+			master := runtime.Master(procs)
+			if master != nil && master.Reloads > before.Reloads {
+				if master.Failed > before.Failed {
+					return nil, fmt.Errorf("HAproxy master reported a failed reload")
+				}
+				return procs, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for the HAproxy master to reload")
+		}
+
+		time.Sleep(MasterReloadInterval)
+	}
+}
+
+// Log the workers the master is now running
+func logWorkers(procs []runtime.Proc) {
+	var current, old []int
+	for _, proc := range procs {
+		if proc.Type != "worker" {
+			continue
+		}
+
+		if proc.Old {
+			old = append(old, proc.Pid)
+		} else {
+			current = append(current, proc.Pid)
+		}
+	}
+
+	log.Infof("HAproxy master reloaded, workers: %v, old workers still draining: %v", current, old)
+}
+
+// StopSupervised stops the HAproxy we are supervising, waiting up to
+// timeout for it to exit. It does nothing in other modes.
+func (h *HAproxy) StopSupervised(timeout time.Duration) {
+	h.supervisorLock.Lock()
+	supervisor := h.supervisor
+	h.supervisorLock.Unlock()
+
+	if supervisor == nil {
+		return
+	}
+
+	log.Info("Stopping HAproxy")
+	if !supervisor.StopAndWait(timeout) {
+		log.Warnf("HAproxy is still running after %s", timeout)
+	}
+}
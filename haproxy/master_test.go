@@ -0,0 +1,99 @@
+package haproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A fake master CLI whose reload count goes up on each "reload"
+func fakeMaster(path string, reloadResponse string) net.Listener {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		reloads := 0
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			switch strings.TrimSpace(line) {
+			case "reload":
+				reloads++
+				conn.Write([]byte(reloadResponse))
+			case "show proc":
+				fmt.Fprintf(conn, "#<PID> <type> <reloads> <uptime> <version>\n"+
+					"100 master %d [failed: 0] 0d00h01m00s 2.5.0\n"+
+					"# workers\n"+
+					"%d worker 0 0d00h00m01s 2.5.0\n", reloads, 200+reloads)
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener
+}
+
+func Test_MasterWorker(t *testing.T) {
+	Convey("Master-worker mode", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "master")
+
+		proxy := New(tmpDir+"/haproxy.cfg", tmpDir+"/haproxy.pid")
+		proxy.Mode = ModeMasterWorker
+		proxy.MasterSocket = tmpDir + "/master.sock"
+
+		Reset(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		Convey("DefaultReloadCmd() starts a master with the master CLI", func() {
+			So(proxy.DefaultReloadCmd(), ShouldEqual,
+				"haproxy -W -D -S "+tmpDir+"/master.sock -f "+tmpDir+"/haproxy.cfg -p "+tmpDir+"/haproxy.pid")
+		})
+
+		Convey("Reload() starts HAproxy when no master is answering", func() {
+			proxy.ReloadCmd = "touch " + tmpDir + "/started"
+
+			err := proxy.Reload()
+			_, statErr := os.Stat(tmpDir + "/started")
+
+			So(err, ShouldBeNil)
+			So(statErr, ShouldBeNil)
+		})
+
+		Convey("Reload() reloads through the master CLI", func() {
+			listener := fakeMaster(proxy.MasterSocket, "Success=1\n--\n")
+			defer listener.Close()
+			proxy.ReloadCmd = "/usr/bin/false"
+
+			So(proxy.Reload(), ShouldBeNil)
+		})
+
+		Convey("Reload() works when the master doesn't report a status", func() {
+			listener := fakeMaster(proxy.MasterSocket, "")
+			defer listener.Close()
+
+			So(proxy.Reload(), ShouldBeNil)
+		})
+
+		Convey("Reload() returns the error when the master fails to reload", func() {
+			listener := fakeMaster(proxy.MasterSocket, "Success=0\n--\n[ALERT] parsing error\n")
+			defer listener.Close()
+
+			err := proxy.Reload()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "[ALERT] parsing error")
+		})
+	})
+}
@@ -0,0 +1,142 @@
+package haproxy
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics for the render/verify/reload pipeline. These are
+// registered with the default registry and served by the /metrics endpoint.
+var (
+	rendersTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_renders_total",
+		Help: "Number of times the HAproxy config template was rendered",
+	})
+	renderFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_render_failures_total",
+		Help: "Number of HAproxy config renders that failed",
+	})
+	renderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "haproxy_api_render_duration_seconds",
+		Help:    "Time taken to render the HAproxy config",
+		Buckets: prometheus.DefBuckets,
+	})
+	verifyFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_verify_failures_total",
+		Help: "Number of HAproxy configs that failed verification",
+	})
+	verifyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "haproxy_api_verify_duration_seconds",
+		Help:    "Time taken to run the HAproxy verify command",
+		Buckets: prometheus.DefBuckets,
+	})
+	reloadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_reloads_total",
+		Help: "Number of times HAproxy was reloaded",
+	})
+	reloadFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_reload_failures_total",
+		Help: "Number of HAproxy reloads that failed",
+	})
+	reloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "haproxy_api_reload_duration_seconds",
+		Help:    "Time taken to run the HAproxy reload command",
+		Buckets: prometheus.DefBuckets,
+	})
+	reloadsSkippedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_reloads_skipped_total",
+		Help: "Number of updates that did not reload HAproxy because the config was unchanged",
+	})
+	runtimeApiUpdatesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_runtime_api_updates_total",
+		Help: "Number of updates applied through the HAproxy Runtime API instead of a reload",
+	})
+	haproxyRestartsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_haproxy_restarts_total",
+		Help: "Number of times the supervised HAproxy was restarted after exiting",
+	})
+	renderedFrontends = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_api_rendered_frontends",
+		Help: "Number of frontends in the last rendered HAproxy config",
+	})
+	renderedBackends = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_api_rendered_backends",
+		Help: "Number of backends in the last rendered HAproxy config",
+	})
+	renderedServers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "haproxy_api_rendered_servers",
+		Help: "Number of backend servers in the last rendered HAproxy config",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "haproxy_api_seconds_since_last_reload",
+		Help: "Seconds since HAproxy last took a new config, by reloading or through the Runtime API, or -1 if it never did",
+	}, secondsSinceLastApplied)
+
+	lastAppliedTime time.Time
+	lastAppliedLock sync.Mutex
+)
+
+// Record the time taken by a render and whether it failed
+func observeRender(start time.Time, err error) {
+	renderDuration.Observe(time.Since(start).Seconds())
+
+	rendersTotal.Inc()
+	if err != nil {
+		renderFailuresTotal.Inc()
+	}
+}
+
+// Record a successful reload or Runtime API update for the
+// haproxy_api_seconds_since_last_reload gauge. Either way, HAproxy is now
+// running the latest config.
+func recordApplied() {
+	lastAppliedLock.Lock()
+	lastAppliedTime = time.Now()
+	lastAppliedLock.Unlock()
+}
+
+func secondsSinceLastApplied() float64 {
+	lastAppliedLock.Lock()
+	defer lastAppliedLock.Unlock()
+
+	if lastAppliedTime.IsZero() {
+		return -1
+	}
+
+	return time.Since(lastAppliedTime).Seconds()
+}
+
+// Count the frontends, backends, and servers in a rendered config and
+// update the gauges.
+func recordConfigSize(config []byte) {
+	var frontends, backends, servers float64
+
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) < 1 {
+			continue
+		}
+
+		switch string(fields[0]) {
+		case "frontend":
+			frontends++
+		case "backend":
+			backends++
+		case "listen":
+			frontends++
+			backends++
+		case "server":
+			servers++
+		}
+	}
+
+	renderedFrontends.Set(frontends)
+	renderedBackends.Set(backends)
+	renderedServers.Set(servers)
+}
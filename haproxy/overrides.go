@@ -0,0 +1,219 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceSettings are the per-service HAproxy settings that templates get
+// from settingsFor. Timeouts are in HAproxy's own format, e.g. "5s" or "1m".
+type ServiceSettings struct {
+	Balance        string `toml:"balance"`
+	TimeoutConnect string `toml:"timeout_connect"`
+	TimeoutClient  string `toml:"timeout_client"`
+	TimeoutServer  string `toml:"timeout_server"`
+	Maxconn        int    `toml:"maxconn"`
+
+	HealthCheck HealthCheck `toml:"health_check"`
+}
+
+// HealthCheck configures HAproxy's active health checks of a service's
+// backend servers. Type is "tcp", "http", or "none" to turn them off.
+type HealthCheck struct {
+	Type         string `toml:"type"`
+	Path         string `toml:"path"`
+	ExpectStatus int    `toml:"expect_status"`
+	Interval     string `toml:"interval"`
+	Rise         int    `toml:"rise"`
+	Fall         int    `toml:"fall"`
+}
+
+// Enabled reports whether servers should be checked at all
+func (c HealthCheck) Enabled() bool {
+	return c.Type == "tcp" || c.Type == "http"
+}
+
+// IsHTTP reports whether servers should be checked with an HTTP request
+func (c HealthCheck) IsHTTP() bool {
+	return c.Type == "http"
+}
+
+// Fill in anything that isn't set in c from other
+func (c HealthCheck) merge(other HealthCheck) HealthCheck {
+	if c.Type == "" {
+		c.Type = other.Type
+	}
+	if c.Path == "" {
+		c.Path = other.Path
+	}
+	if c.ExpectStatus == 0 {
+		c.ExpectStatus = other.ExpectStatus
+	}
+	if c.Interval == "" {
+		c.Interval = other.Interval
+	}
+	if c.Rise == 0 {
+		c.Rise = other.Rise
+	}
+	if c.Fall == 0 {
+		c.Fall = other.Fall
+	}
+
+	return c
+}
+
+// DefaultServiceSettings are used for anything not set in the overrides file
+var DefaultServiceSettings = ServiceSettings{
+	Balance:        "roundrobin",
+	TimeoutConnect: "5s",
+	TimeoutClient:  "1m",
+	TimeoutServer:  "1m",
+	Maxconn:        4096,
+	HealthCheck: HealthCheck{
+		Type:         "none",
+		Path:         "/",
+		ExpectStatus: 200,
+		Interval:     "2s",
+		Rise:         2,
+		Fall:         3,
+	},
+}
+
+// Overrides is the contents of the overrides file. Defaults apply to every
+// service, and Services to individual ones by their Sidecar service name.
+//
+//	[defaults]
+//	timeout_server = "2m"
+//
+//	[services.some-db]
+//	balance        = "leastconn"
+//	timeout_server = "30m"
+type Overrides struct {
+	Defaults ServiceSettings            `toml:"defaults"`
+	Services map[string]ServiceSettings `toml:"services"`
+}
+
+// Fill in anything that isn't set in s from other
+func (s ServiceSettings) merge(other ServiceSettings) ServiceSettings {
+	if s.Balance == "" {
+		s.Balance = other.Balance
+	}
+	if s.TimeoutConnect == "" {
+		s.TimeoutConnect = other.TimeoutConnect
+	}
+	if s.TimeoutClient == "" {
+		s.TimeoutClient = other.TimeoutClient
+	}
+	if s.TimeoutServer == "" {
+		s.TimeoutServer = other.TimeoutServer
+	}
+	if s.Maxconn == 0 {
+		s.Maxconn = other.Maxconn
+	}
+	s.HealthCheck = s.HealthCheck.merge(other.HealthCheck)
+
+	return s
+}
+
+// Parse an overrides file. Unknown keys are an error so that typos don't go
+// unnoticed.
+func parseOverrides(path string) (*Overrides, error) {
+	var overrides Overrides
+	meta, err := toml.DecodeFile(path, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing overrides file '%s': %s", path, err)
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("Unknown settings in overrides file '%s': %v", path, undecoded)
+	}
+
+	return &overrides, nil
+}
+
+// LoadOverrides reads the OverridesFile, if there is one. If it fails to
+// parse, the previously loaded overrides are kept and an error is returned.
+func (h *HAproxy) LoadOverrides() error {
+	if h.OverridesFile == "" {
+		return nil
+	}
+
+	stat, err := os.Stat(h.OverridesFile)
+	if err != nil {
+		return fmt.Errorf("Error reading overrides file '%s': %s", h.OverridesFile, err)
+	}
+
+	overrides, err := parseOverrides(h.OverridesFile)
+
+	h.overridesLock.Lock()
+	defer h.overridesLock.Unlock()
+
+	h.overridesSeen = stat.ModTime()
+	if err != nil {
+		return err
+	}
+	h.overrides = overrides
+
+	return nil
+}
+
+// The settings for a service: its overrides, then the defaults from the
+// overrides file, then the health check from the [haproxy] section, then
+// DefaultServiceSettings
+func (h *HAproxy) settingsFor(svcName string) ServiceSettings {
+	h.overridesLock.RLock()
+	defer h.overridesLock.RUnlock()
+
+	var settings ServiceSettings
+	if h.overrides != nil {
+		settings = h.overrides.Services[svcName].merge(h.overrides.Defaults)
+	}
+
+	global := ServiceSettings{HealthCheck: h.HealthCheck}
+	return settings.merge(global).merge(DefaultServiceSettings)
+}
+
+// Returns true if the overrides file has changed since we last loaded it
+func (h *HAproxy) overridesChanged() bool {
+	stat, err := os.Stat(h.OverridesFile)
+	if err != nil {
+		return false
+	}
+
+	h.overridesLock.RLock()
+	defer h.overridesLock.RUnlock()
+
+	return !stat.ModTime().Equal(h.overridesSeen)
+}
+
+// WatchOverrides checks the overrides file on each iteration of the looper
+// and re-reads it when it has changed, calling onChange if that worked. If it
+// fails to parse, we log the error and keep the old overrides. This is a
+// blocking call.
+func (h *HAproxy) WatchOverrides(looper director.Looper, onChange func()) {
+	if h.OverridesFile == "" {
+		return
+	}
+
+	looper.Loop(func() error {
+		if !h.overridesChanged() {
+			return nil
+		}
+
+		log.Info("Overrides file changed on disk, reloading it")
+		if err := h.LoadOverrides(); err != nil {
+			log.Errorf("Keeping previous overrides: %s", err)
+			return nil
+		}
+
+		if onChange != nil {
+			onChange()
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,114 @@
+package haproxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/service"
+)
+
+// A PortGroup is a set of instances of one service that all expose the same
+// ServicePorts. During a migration where a service gains or loses a port,
+// it will have more than one group.
+type PortGroup struct {
+	Ports     []string        `json:"ports"`
+	Instances []PortGroupItem `json:"instances"`
+}
+
+// An instance in a PortGroup
+type PortGroupItem struct {
+	Hostname string `json:"hostname"`
+	ID       string `json:"id"`
+}
+
+// PortGroups reports how the instances of each service are grouped by the
+// ServicePorts they expose.
+func PortGroups(state *catalog.ServicesState) map[string][]PortGroup {
+	state.RLock()
+	services := servicesWithPorts(state)
+	state.RUnlock()
+
+	return groupByPorts(services)
+}
+
+// Group the instances of each service by their sorted list of ServicePorts.
+// Groups are in the order their first instance appears.
+func groupByPorts(services map[string][]*service.Service) map[string][]PortGroup {
+	groups := make(map[string][]PortGroup, len(services))
+
+	for svcName, svcList := range services {
+		indexes := make(map[string]int)
+
+		for _, svc := range svcList {
+			ports := getSortedServicePorts(svc)
+			signature := strings.Join(ports, ",")
+
+			idx, ok := indexes[signature]
+			if !ok {
+				idx = len(groups[svcName])
+				indexes[signature] = idx
+				groups[svcName] = append(groups[svcName], PortGroup{Ports: ports})
+			}
+
+			groups[svcName][idx].Instances = append(groups[svcName][idx].Instances,
+				PortGroupItem{Hostname: svc.Hostname, ID: svc.ID},
+			)
+		}
+	}
+
+	return groups
+}
+
+// Return the instances that expose the given ServicePort
+func servicesForPort(svcList []*service.Service, svcPort string) []*service.Service {
+	matchPort, err := strconv.ParseInt(svcPort, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	var matches []*service.Service
+	for _, svc := range svcList {
+		for _, port := range svc.Ports {
+			if port.ServicePort == matchPort {
+				matches = append(matches, svc)
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// Keep only the instances that expose every one of their service's ports.
+// This is what templates get in .Services, so that ones written before
+// servicesFor, which range over all of a service's instances for each port,
+// still render a server line for every port. Every service is kept, even if
+// it's left with no instances, so templates still render its backends.
+func servicesWithAllPorts(services map[string][]*service.Service, ports portmap) map[string][]*service.Service {
+	complete := make(map[string][]*service.Service, len(services))
+
+	for svcName, svcList := range services {
+		complete[svcName] = []*service.Service{}
+
+		for _, svc := range svcList {
+			if hasAllPorts(svc, ports[svcName]) {
+				complete[svcName] = append(complete[svcName], svc)
+			}
+		}
+	}
+
+	return complete
+}
+
+func hasAllPorts(svc *service.Service, ports typedPorts) bool {
+	for portType, portSet := range ports {
+		for svcPort := range portSet {
+			if findPortForServiceByType(svcPort, portType, svc) == "-1" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,67 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Nitro/sidecar/catalog"
+)
+
+// A Preview is what applying a state would do to the main HAproxy config
+type Preview struct {
+	Config string   `json:"config"`
+	Diff   string   `json:"diff"`
+	Errors []string `json:"errors"`
+}
+
+// Preview renders the state and verifies the result without writing
+// ConfigFile or reloading HAproxy. The diff is against the config that is
+// currently live. Verify failures are reported in the Preview's Errors, while
+// an error is returned only when the config can't be rendered at all.
+func (h *HAproxy) Preview(state *catalog.ServicesState) (*Preview, error) {
+	// Previews are kept out of the render metrics
+	config, err := h.renderMain(state)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{Config: string(config), Errors: []string{}}
+
+	// If nothing is live yet, everything shows up as added
+	live, _ := h.CurrentConfig()
+
+	preview.Diff, err = unifiedDiff(live, config, "live", "preview")
+	if err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+
+	if err := h.verifyPreview(config); err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+
+	return preview, nil
+}
+
+// Run the verify command against a temp copy of a previewed config. This
+// doesn't go through verify() so that previews don't show up in the metrics.
+func (h *HAproxy) verifyPreview(config []byte) error {
+	file, err := ioutil.TempFile("", "haproxy-api-preview")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(config)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to write temp file: %s", err)
+	}
+
+	command, err := h.verifyCmdFor(file.Name())
+	if err != nil {
+		return err
+	}
+
+	return h.run(command)
+}
@@ -0,0 +1,135 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Proc is one process from the master CLI's "show proc" output
+type Proc struct {
+	Pid     int
+	Type    string // "master", "worker", or "program"
+	Reloads int
+	Failed  int // Failed reloads, only reported for the master by newer HAproxy
+	Uptime  string
+	Version string
+	Old     bool // A worker left over from before a reload, still draining
+}
+
+// The result of asking the master to reload. Older versions of HAproxy
+// close the connection without reporting anything, in which case Reported
+// is false and the caller has to check "show proc" to see what happened.
+type ReloadStatus struct {
+	Reported bool
+	Success  bool
+	Output   string
+}
+
+// Reload asks the HAproxy master, over the master CLI socket, to re-read
+// its config and start new workers
+func (c *Client) Reload() (*ReloadStatus, error) {
+	response, err := c.Execute("reload")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseReloadStatus(response), nil
+}
+
+// ShowProc returns the master and worker processes from the master CLI
+func (c *Client) ShowProc() ([]Proc, error) {
+	response, err := c.Execute("show proc")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseProcs(response)
+}
+
+// Master returns the master process from a "show proc" listing
+func Master(procs []Proc) *Proc {
+	for i := range procs {
+		if procs[i].Type == "master" {
+			return &procs[i]
+		}
+	}
+
+	return nil
+}
+
+// Parse the reply to "reload". Newer HAproxy sends "Success=1" or
+// "Success=0", then "--" and the startup messages.
+func parseReloadStatus(response string) *ReloadStatus {
+	status := &ReloadStatus{}
+
+	parts := strings.SplitN(response, "\n", 2)
+	first := strings.TrimSpace(parts[0])
+	if !strings.HasPrefix(first, "Success=") {
+		status.Output = strings.TrimSpace(response)
+		return status
+	}
+
+	status.Reported = true
+	status.Success = first == "Success=1"
+	if len(parts) > 1 {
+		status.Output = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(parts[1]), "--"))
+	}
+
+	return status
+}
+
+// Parse the output of "show proc". The sections are separated by comment
+// lines and each process line looks like:
+//
+//	1162   master   5 [failed: 0]   0d00h02m07s   2.5.0
+func parseProcs(response string) ([]Proc, error) {
+	var procs []Proc
+	old := false
+
+	scanner := bufio.NewScanner(strings.NewReader(response))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			old = strings.Contains(line, "old")
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("Unexpected 'show proc' output: %s", line)
+		}
+
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected 'show proc' output: %s", line)
+		}
+
+		proc := Proc{
+			Pid:     pid,
+			Type:    fields[1],
+			Uptime:  fields[len(fields)-2],
+			Version: fields[len(fields)-1],
+			Old:     old,
+		}
+		proc.Reloads, _ = strconv.Atoi(fields[2])
+
+		// Newer versions add "[failed: N]" after the reload count
+		if len(fields) >= 7 && fields[3] == "[failed:" {
+			proc.Failed, _ = strconv.Atoi(strings.TrimSuffix(fields[4], "]"))
+		}
+
+		procs = append(procs, proc)
+	}
+
+	if len(procs) == 0 {
+		return nil, fmt.Errorf("Empty 'show proc' output from HAproxy")
+	}
+
+	return procs, scanner.Err()
+}
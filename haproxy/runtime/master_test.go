@@ -0,0 +1,69 @@
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MasterCli(t *testing.T) {
+	Convey("Master CLI", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "master")
+		sockPath := filepath.Join(tmpDir, "master.sock")
+
+		sock := newFakeSocket(sockPath, map[string]string{
+			"show proc": "#<PID>          <type>          <reloads>       <uptime>        <version>\n" +
+				"1162            master          5 [failed: 1]   0d00h02m07s     2.5.0\n" +
+				"# workers\n" +
+				"1271            worker          1               0d00h00m00s     2.5.0\n" +
+				"# old workers\n" +
+				"1233            worker          3               0d00h00m43s     2.5.0\n" +
+				"# programs\n",
+			"reload": "Success=1\n--\n[NOTICE]   (1162) : Loading success.\n",
+		})
+
+		client := NewClient(sockPath)
+
+		Reset(func() {
+			sock.listener.Close()
+			os.RemoveAll(tmpDir)
+		})
+
+		Convey("ShowProc() parses the master and workers", func() {
+			procs, err := client.ShowProc()
+
+			So(err, ShouldBeNil)
+			So(len(procs), ShouldEqual, 3)
+			So(procs[0], ShouldResemble, Proc{
+				Pid: 1162, Type: "master", Reloads: 5, Failed: 1, Uptime: "0d00h02m07s", Version: "2.5.0",
+			})
+			So(procs[1].Pid, ShouldEqual, 1271)
+			So(procs[1].Old, ShouldBeFalse)
+			So(procs[2].Pid, ShouldEqual, 1233)
+			So(procs[2].Old, ShouldBeTrue)
+			So(Master(procs).Pid, ShouldEqual, 1162)
+		})
+
+		Convey("Reload() reads back the status", func() {
+			status, err := client.Reload()
+
+			So(err, ShouldBeNil)
+			So(status.Reported, ShouldBeTrue)
+			So(status.Success, ShouldBeTrue)
+			So(status.Output, ShouldEqual, "[NOTICE]   (1162) : Loading success.")
+		})
+
+		Convey("parseReloadStatus() handles failures and older versions", func() {
+			status := parseReloadStatus("Success=0\n--\n[ALERT] config error\n")
+			So(status.Reported, ShouldBeTrue)
+			So(status.Success, ShouldBeFalse)
+			So(status.Output, ShouldEqual, "[ALERT] config error")
+
+			status = parseReloadStatus("")
+			So(status.Reported, ShouldBeFalse)
+		})
+	})
+}
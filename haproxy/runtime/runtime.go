@@ -0,0 +1,265 @@
+// Package runtime is a small client for the HAproxy Runtime API, spoken over
+// the stats socket declared with "stats socket ... level admin" in the config.
+// It lets us change servers in a running HAproxy without a reload.
+package runtime
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+)
+
+// Valid server states for SetServerState()
+const (
+	StateReady = "ready"
+	StateDrain = "drain"
+	StateMaint = "maint"
+)
+
+// A Stat is one row of "show stat" output, keyed by the CSV column name
+// (e.g. "pxname", "svname", "status").
+type Stat map[string]string
+
+// Info is the output of "show info", keyed by field name (e.g. "Pid",
+// "Uptime_sec", "CurrConns").
+type Info map[string]string
+
+// A ServerState is one row of "show servers state" output, keyed by the
+// column name (e.g. "be_name", "srv_name", "srv_addr").
+type ServerState map[string]string
+
+// A Client talks to one HAproxy Runtime API socket. Each command is sent on
+// its own connection, which is how HAproxy expects non-interactive use.
+type Client struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+// Return a properly configured Client for the socket at socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{
+		SocketPath: socketPath,
+		Timeout:    DefaultTimeout,
+	}
+}
+
+// Execute sends a single command to HAproxy and returns the raw response
+func (c *Client) Execute(command string) (string, error) {
+	conn, err := net.DialTimeout("unix", c.SocketPath, c.Timeout)
+	if err != nil {
+		return "", fmt.Errorf("Unable to connect to HAproxy socket %s: %s", c.SocketPath, err)
+	}
+	defer conn.Close()
+
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	_, err = io.WriteString(conn, command+"\n")
+	if err != nil {
+		return "", fmt.Errorf("Unable to send '%s' to HAproxy: %s", command, err)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read response to '%s' from HAproxy: %s", command, err)
+	}
+
+	return string(response), nil
+}
+
+// Run a command that prints nothing when it succeeds. Anything HAproxy
+// sends back is an error message.
+func (c *Client) executeQuiet(command string) error {
+	response, err := c.Execute(command)
+	if err != nil {
+		return err
+	}
+
+	if msg := strings.TrimSpace(response); msg != "" {
+		return fmt.Errorf("HAproxy rejected '%s': %s", command, msg)
+	}
+
+	return nil
+}
+
+// Run a command whose successful response starts with one of the expected
+// prefixes. Anything else is an error message.
+func (c *Client) executeExpecting(command string, prefixes ...string) error {
+	response, err := c.Execute(command)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.TrimSpace(response)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(msg, prefix) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("HAproxy rejected '%s': %s", command, msg)
+}
+
+// ShowInfo returns the parsed output of "show info"
+func (c *Client) ShowInfo() (Info, error) {
+	response, err := c.Execute("show info")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseInfo(response)
+}
+
+// ShowStat returns the parsed output of "show stat"
+func (c *Client) ShowStat() ([]Stat, error) {
+	response, err := c.Execute("show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStat(response)
+}
+
+// ShowServersState returns the parsed output of "show servers state". If
+// backend is empty, all backends are returned.
+func (c *Client) ShowServersState(backend string) ([]ServerState, error) {
+	response, err := c.Execute(strings.TrimSpace("show servers state " + backend))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseServersState(response)
+}
+
+// SetServerState changes the administrative state of a server to one of
+// StateReady, StateDrain, or StateMaint.
+func (c *Client) SetServerState(backend string, server string, state string) error {
+	return c.executeQuiet(fmt.Sprintf("set server %s/%s state %s", backend, server, state))
+}
+
+// SetServerWeight changes the weight of a server
+func (c *Client) SetServerWeight(backend string, server string, weight int) error {
+	return c.executeQuiet(fmt.Sprintf("set server %s/%s weight %d", backend, server, weight))
+}
+
+// SetServerAddr points a server at a new address and port
+func (c *Client) SetServerAddr(backend string, server string, addr string, port string) error {
+	return c.executeExpecting(
+		fmt.Sprintf("set server %s/%s addr %s port %s", backend, server, addr, port),
+		"IP changed", "port changed", "no need to change",
+	)
+}
+
+// AddServer creates a new server in a backend. The options are any server
+// keywords (e.g. "cookie foo", "check") supported by dynamic servers. New
+// servers start in maintenance mode and must be enabled with SetServerState.
+func (c *Client) AddServer(backend string, server string, addr string, port string, options ...string) error {
+	command := fmt.Sprintf("add server %s/%s %s:%s", backend, server, addr, port)
+	if len(options) > 0 {
+		command += " " + strings.Join(options, " ")
+	}
+
+	return c.executeExpecting(command, "New server registered")
+}
+
+// DelServer removes a server from a backend. HAproxy requires the server
+// to be in maintenance mode with no remaining connections.
+func (c *Client) DelServer(backend string, server string) error {
+	return c.executeExpecting(fmt.Sprintf("del server %s/%s", backend, server), "Server deleted")
+}
+
+// EnableHealth turns on active health checks for a server
+func (c *Client) EnableHealth(backend string, server string) error {
+	return c.executeQuiet(fmt.Sprintf("enable health %s/%s", backend, server))
+}
+
+// Parse the "Name: value" lines of "show info"
+func parseInfo(response string) (Info, error) {
+	info := make(Info)
+
+	scanner := bufio.NewScanner(strings.NewReader(response))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		info[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	if len(info) == 0 {
+		return nil, fmt.Errorf("Empty 'show info' output from HAproxy")
+	}
+
+	return info, scanner.Err()
+}
+
+// Parse the CSV output of "show stat". The header line starts with "# ".
+func parseStat(response string) ([]Stat, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(response, "# ")))
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse 'show stat' output: %s", err)
+	}
+
+	if len(records) < 1 {
+		return nil, fmt.Errorf("Empty 'show stat' output from HAproxy")
+	}
+
+	header := records[0]
+	stats := make([]Stat, 0, len(records)-1)
+	for _, record := range records[1:] {
+		stat := make(Stat, len(header))
+		for i, field := range record {
+			if i < len(header) && header[i] != "" {
+				stat[header[i]] = field
+			}
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+// Parse the output of "show servers state". The first line is the format
+// version, the second is a "# "-prefixed header, and the rest are
+// space-separated rows.
+func parseServersState(response string) ([]ServerState, error) {
+	var header []string
+	var states []ServerState
+
+	scanner := bufio.NewScanner(strings.NewReader(response))
+	for lineNum := 0; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case lineNum == 0 || line == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			header = strings.Fields(strings.TrimPrefix(line, "#"))
+		default:
+			if header == nil {
+				return nil, fmt.Errorf("Unexpected 'show servers state' output: %s", line)
+			}
+			state := make(ServerState, len(header))
+			for i, field := range strings.Fields(line) {
+				if i < len(header) {
+					state[header[i]] = field
+				}
+			}
+			states = append(states, state)
+		}
+	}
+
+	return states, scanner.Err()
+}
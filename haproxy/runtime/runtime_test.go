@@ -0,0 +1,155 @@
+package runtime
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A fake HAproxy stats socket. Replies to each command with the canned
+// response registered for it and records what it received.
+type fakeSocket struct {
+	listener  net.Listener
+	responses map[string]string
+	received  []string
+	lock      sync.Mutex
+}
+
+func newFakeSocket(path string, responses map[string]string) *fakeSocket {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic(err)
+	}
+
+	sock := &fakeSocket{listener: listener, responses: responses}
+	go sock.serve()
+
+	return sock
+}
+
+func (s *fakeSocket) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		command := strings.TrimSpace(line)
+
+		s.lock.Lock()
+		s.received = append(s.received, command)
+		s.lock.Unlock()
+
+		conn.Write([]byte(s.responses[command]))
+		conn.Close()
+	}
+}
+
+func (s *fakeSocket) Received() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.received
+}
+
+func Test_Client(t *testing.T) {
+	Convey("Client", t, func() {
+		tmpDir, _ := ioutil.TempDir("", "runtime")
+		sockPath := filepath.Join(tmpDir, "haproxy.sock")
+
+		sock := newFakeSocket(sockPath, map[string]string{
+			"show info": "Name: HAProxy\nVersion: 2.4.0\nPid: 123\nUptime_sec: 42\n",
+			"show stat": "# pxname,svname,status,weight,\n" +
+				"awesome-svc-8080,FRONTEND,OPEN,,\n" +
+				"awesome-svc-8080,indomitable-deadbeef123,UP,1,\n",
+			"show servers state awesome-svc-8080": "1\n" +
+				"# be_id be_name srv_id srv_name srv_addr srv_op_state\n" +
+				"3 awesome-svc-8080 1 indomitable-deadbeef123 127.0.0.1 2\n",
+			"set server awesome-svc-8080/indomitable-deadbeef123 state drain":          "\n",
+			"set server awesome-svc-8080/indomitable-deadbeef123 weight 0":             "\n",
+			"set server awesome-svc-8080/nope state maint":                             "No such server.\n",
+			"set server awesome-svc-8080/indomitable-deadbeef123 addr 10.0.0.1 port 9": "IP changed from '127.0.0.1' to '10.0.0.1', port changed from '10450' to '9' by 'stats socket command'\n",
+			"add server awesome-svc-8080/new 10.0.0.2:8000 cookie new check":           "New server registered.\n",
+			"del server awesome-svc-8080/indomitable-deadbeef123":                      "Server deleted.\n",
+			"del server awesome-svc-8080/busy":                                         "Server still has connections attached to it, cannot remove it.\n",
+		})
+
+		client := NewClient(sockPath)
+
+		Reset(func() {
+			sock.listener.Close()
+			os.RemoveAll(tmpDir)
+		})
+
+		Convey("ShowStat() parses the CSV output", func() {
+			stats, err := client.ShowStat()
+
+			So(err, ShouldBeNil)
+			So(len(stats), ShouldEqual, 2)
+			So(stats[1]["pxname"], ShouldEqual, "awesome-svc-8080")
+			So(stats[1]["svname"], ShouldEqual, "indomitable-deadbeef123")
+			So(stats[1]["status"], ShouldEqual, "UP")
+		})
+
+		Convey("ShowInfo() parses the fields", func() {
+			info, err := client.ShowInfo()
+
+			So(err, ShouldBeNil)
+			So(info["Name"], ShouldEqual, "HAProxy")
+			So(info["Pid"], ShouldEqual, "123")
+			So(info["Uptime_sec"], ShouldEqual, "42")
+		})
+
+		Convey("ShowServersState() parses the output for a backend", func() {
+			states, err := client.ShowServersState("awesome-svc-8080")
+
+			So(err, ShouldBeNil)
+			So(len(states), ShouldEqual, 1)
+			So(states[0]["srv_name"], ShouldEqual, "indomitable-deadbeef123")
+			So(states[0]["srv_addr"], ShouldEqual, "127.0.0.1")
+		})
+
+		Convey("SetServerState() and SetServerWeight() send the right commands", func() {
+			So(client.SetServerState("awesome-svc-8080", "indomitable-deadbeef123", StateDrain), ShouldBeNil)
+			So(client.SetServerWeight("awesome-svc-8080", "indomitable-deadbeef123", 0), ShouldBeNil)
+			So(sock.Received(), ShouldResemble, []string{
+				"set server awesome-svc-8080/indomitable-deadbeef123 state drain",
+				"set server awesome-svc-8080/indomitable-deadbeef123 weight 0",
+			})
+		})
+
+		Convey("SetServerAddr() accepts the change message", func() {
+			err := client.SetServerAddr("awesome-svc-8080", "indomitable-deadbeef123", "10.0.0.1", "9")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("AddServer() and DelServer() work", func() {
+			So(client.AddServer("awesome-svc-8080", "new", "10.0.0.2", "8000", "cookie", "new", "check"), ShouldBeNil)
+			So(client.DelServer("awesome-svc-8080", "indomitable-deadbeef123"), ShouldBeNil)
+		})
+
+		Convey("returns errors that HAproxy sends back", func() {
+			err := client.SetServerState("awesome-svc-8080", "nope", StateMaint)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "No such server")
+
+			err = client.DelServer("awesome-svc-8080", "busy")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "still has connections")
+		})
+
+		Convey("returns an error when the socket isn't there", func() {
+			client.SocketPath = filepath.Join(tmpDir, "missing.sock")
+			_, err := client.Execute("show info")
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
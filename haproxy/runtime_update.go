@@ -0,0 +1,224 @@
+package haproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Nitro/haproxy-api/haproxy/runtime"
+	log "github.com/sirupsen/logrus"
+)
+
+// A server line from a backend section of a rendered config
+type serverLine struct {
+	Backend string
+	Name    string
+	Addr    string
+	Port    string
+	Options []string
+}
+
+// The parts of a rendered config we care about when deciding if a change can
+// be made through the Runtime API. The skeleton is every meaningful line that
+// isn't a backend server line. If two configs have the same skeleton, they only
+// differ in their backend servers.
+type parsedConfig struct {
+	skeleton []string
+	servers  map[string]map[string]*serverLine // backend -> server name -> line
+}
+
+// A single server-level change to make through the Runtime API
+type serverChange struct {
+	Action string // "add", "del", "addr", or "weight"
+	Server *serverLine
+}
+
+// Split a rendered config into its skeleton and backend servers. Comments and
+// blank lines are dropped since they don't change what HAproxy does.
+func parseRenderedConfig(config []byte) *parsedConfig {
+	parsed := &parsedConfig{servers: make(map[string]map[string]*serverLine)}
+	var backend string
+
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		indented := scanner.Text()[0] == ' ' || scanner.Text()[0] == '\t'
+
+		// Section headers aren't indented. We only track servers in backends.
+		if !indented {
+			backend = ""
+			if fields[0] == "backend" && len(fields) > 1 {
+				backend = fields[1]
+				parsed.servers[backend] = make(map[string]*serverLine)
+			}
+		}
+
+		if backend != "" && fields[0] == "server" && len(fields) > 2 {
+			if server := parseServerLine(backend, fields); server != nil {
+				parsed.servers[backend][server.Name] = server
+				continue
+			}
+		}
+
+		parsed.skeleton = append(parsed.skeleton, strings.Join(fields, " "))
+	}
+
+	return parsed
+}
+
+// Parse "server <name> <addr>:<port> [options...]". Returns nil if the address
+// isn't in a form we can manage at runtime.
+func parseServerLine(backend string, fields []string) *serverLine {
+	idx := strings.LastIndex(fields[2], ":")
+	if idx < 1 || idx == len(fields[2])-1 {
+		return nil
+	}
+
+	return &serverLine{
+		Backend: backend,
+		Name:    fields[1],
+		Addr:    fields[2][:idx],
+		Port:    fields[2][idx+1:],
+		Options: fields[3:],
+	}
+}
+
+// Work out the server changes needed to get from the old config to the new
+// one. Returns an error when the configs differ in ways the Runtime API can't
+// handle, in which case a full reload is required.
+func serverChanges(oldConfig, newConfig *parsedConfig) ([]serverChange, error) {
+	if strings.Join(oldConfig.skeleton, "\n") != strings.Join(newConfig.skeleton, "\n") {
+		return nil, fmt.Errorf("config changed outside of backend servers")
+	}
+
+	var adds, dels, addrs, weights []serverChange
+	for backend, newServers := range newConfig.servers {
+		oldServers := oldConfig.servers[backend]
+
+		for name, server := range newServers {
+			oldServer, ok := oldServers[name]
+			if !ok {
+				adds = append(adds, serverChange{Action: "add", Server: server})
+				continue
+			}
+
+			oldWeight, oldOptions := serverWeight(oldServer.Options)
+			newWeight, newOptions := serverWeight(server.Options)
+			if strings.Join(oldOptions, " ") != strings.Join(newOptions, " ") {
+				return nil, fmt.Errorf("options changed for server %s/%s", backend, name)
+			}
+
+			if oldServer.Addr != server.Addr || oldServer.Port != server.Port {
+				addrs = append(addrs, serverChange{Action: "addr", Server: server})
+			}
+
+			if oldWeight != newWeight {
+				weights = append(weights, serverChange{Action: "weight", Server: server})
+			}
+		}
+
+		for name, server := range oldServers {
+			if _, ok := newServers[name]; !ok {
+				dels = append(dels, serverChange{Action: "del", Server: server})
+			}
+		}
+	}
+
+	// Add before removing so a backend isn't left empty in between
+	changes := append(append(adds, addrs...), weights...)
+	return append(changes, dels...), nil
+}
+
+// Apply a single change to the running HAproxy
+func (c serverChange) apply(client *runtime.Client) error {
+	srv := c.Server
+
+	switch c.Action {
+	case "add":
+		err := client.AddServer(srv.Backend, srv.Name, srv.Addr, srv.Port, srv.Options...)
+		if err != nil {
+			return err
+		}
+		if hasOption(srv.Options, "check") {
+			if err := client.EnableHealth(srv.Backend, srv.Name); err != nil {
+				return err
+			}
+		}
+		return client.SetServerState(srv.Backend, srv.Name, runtime.StateReady)
+	case "addr":
+		return client.SetServerAddr(srv.Backend, srv.Name, srv.Addr, srv.Port)
+	case "weight":
+		weight, _ := serverWeight(srv.Options)
+		return client.SetServerWeight(srv.Backend, srv.Name, weight)
+	case "del":
+		err := client.SetServerState(srv.Backend, srv.Name, runtime.StateMaint)
+		if err != nil {
+			return err
+		}
+		return client.DelServer(srv.Backend, srv.Name)
+	}
+
+	return fmt.Errorf("unknown server change '%s'", c.Action)
+}
+
+// Split the weight out of a server's options, since it's the one option we
+// can change at runtime. Servers without one get HAproxy's default of 1.
+func serverWeight(options []string) (int, []string) {
+	weight := 1
+	var rest []string
+
+	for i := 0; i < len(options); i++ {
+		if options[i] == "weight" && i+1 < len(options) {
+			if w, err := strconv.Atoi(options[i+1]); err == nil {
+				weight = w
+				i++
+				continue
+			}
+		}
+		rest = append(rest, options[i])
+	}
+
+	return weight, rest
+}
+
+func hasOption(options []string, option string) bool {
+	for _, opt := range options {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Try to get HAproxy running the new config through the Runtime API instead
+// of reloading it. This only works when the last applied config and the new one
+// differ just in backend servers being added, removed, re-addressed, or
+// re-weighted (e.g. when a service starts draining). If
+// this returns an error, the caller needs to fall back to a full reload.
+func (h *HAproxy) applyRuntimeChanges(config []byte) error {
+	if h.lastApplied == nil {
+		return fmt.Errorf("no previously applied config")
+	}
+
+	changes, err := serverChanges(parseRenderedConfig(h.lastApplied), parseRenderedConfig(config))
+	if err != nil {
+		return err
+	}
+
+	client := runtime.NewClient(h.StatsSocket)
+	for _, change := range changes {
+		log.Infof("Runtime API: %s server %s/%s", change.Action, change.Server.Backend, change.Server.Name)
+		if err := change.apply(client); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
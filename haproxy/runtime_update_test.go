@@ -0,0 +1,117 @@
+package haproxy
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var baseConfig = `
+# Auto-generated at some time
+global
+	daemon
+
+frontend awesome-svc-8080
+	mode http
+	bind 192.168.168.168:8080
+	default_backend awesome-svc-8080
+
+backend awesome-svc-8080
+	mode http
+	server indomitable-deadbeef123 127.0.0.1:10450 cookie indomitable-10450
+	server indefatigable-deadbeef101 127.0.0.3:32763 cookie indefatigable-32763
+`
+
+func Test_serverChanges(t *testing.T) {
+	Convey("serverChanges()", t, func() {
+		old := parseRenderedConfig([]byte(baseConfig))
+
+		Convey("finds nothing to do when only comments change", func() {
+			changes, err := serverChanges(old, parseRenderedConfig([]byte("# different\n"+baseConfig)))
+
+			So(err, ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+		})
+
+		Convey("finds added, removed and moved servers", func() {
+			newConfig := `
+global
+	daemon
+
+frontend awesome-svc-8080
+	mode http
+	bind 192.168.168.168:8080
+	default_backend awesome-svc-8080
+
+backend awesome-svc-8080
+	mode http
+	server indomitable-deadbeef123 127.0.0.2:10450 cookie indomitable-10450
+	server titanic-deadbeef999 127.0.0.9:1234 cookie titanic-1234
+`
+			changes, err := serverChanges(old, parseRenderedConfig([]byte(newConfig)))
+
+			So(err, ShouldBeNil)
+			So(len(changes), ShouldEqual, 3)
+
+			So(changes[0].Action, ShouldEqual, "add")
+			So(changes[0].Server.Name, ShouldEqual, "titanic-deadbeef999")
+			So(changes[0].Server.Addr, ShouldEqual, "127.0.0.9")
+			So(changes[0].Server.Port, ShouldEqual, "1234")
+			So(changes[0].Server.Options, ShouldResemble, []string{"cookie", "titanic-1234"})
+
+			So(changes[1].Action, ShouldEqual, "addr")
+			So(changes[1].Server.Addr, ShouldEqual, "127.0.0.2")
+
+			So(changes[2].Action, ShouldEqual, "del")
+			So(changes[2].Server.Name, ShouldEqual, "indefatigable-deadbeef101")
+		})
+
+		Convey("finds servers that started draining", func() {
+			newConfig := strings.Replace(baseConfig,
+				"cookie indomitable-10450", "cookie indomitable-10450 weight 0", 1)
+
+			changes, err := serverChanges(old, parseRenderedConfig([]byte(newConfig)))
+
+			So(err, ShouldBeNil)
+			So(len(changes), ShouldEqual, 1)
+			So(changes[0].Action, ShouldEqual, "weight")
+			So(changes[0].Server.Name, ShouldEqual, "indomitable-deadbeef123")
+
+			weight, options := serverWeight(changes[0].Server.Options)
+			So(weight, ShouldEqual, 0)
+			So(options, ShouldResemble, []string{"cookie", "indomitable-10450"})
+		})
+
+		Convey("refuses when something besides servers changed", func() {
+			newConfig := baseConfig + `
+frontend some-svc-8090
+	mode tcp
+	bind 192.168.168.168:8090
+`
+			_, err := serverChanges(old, parseRenderedConfig([]byte(newConfig)))
+
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("refuses when server options changed", func() {
+			newConfig := `
+global
+	daemon
+
+frontend awesome-svc-8080
+	mode http
+	bind 192.168.168.168:8080
+	default_backend awesome-svc-8080
+
+backend awesome-svc-8080
+	mode http
+	server indomitable-deadbeef123 127.0.0.1:10450 cookie something-else
+	server indefatigable-deadbeef101 127.0.0.3:32763 cookie indefatigable-32763
+`
+			_, err := serverChanges(old, parseRenderedConfig([]byte(newConfig)))
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package haproxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+var errSchedulerStopped = errors.New("scheduler stopped")
+
+// A Clock provides the time to the Scheduler so that tests can control it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now().UTC() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// A Scheduler sits in front of a write-and-reload function and coalesces
+// bursts of updates into as few calls as possible. Each update is held for
+// the Debounce window and pushed back by every new update that arrives inside
+// it, but never longer than MaxDelay after the first pending update. Calls are
+// never made closer together than MinInterval. Only the most recent state is
+// passed on. A zero value for any setting disables it.
+type Scheduler struct {
+	Debounce    time.Duration
+	MinInterval time.Duration
+	MaxDelay    time.Duration
+
+	clock        Clock
+	update       func(state *catalog.ServicesState)
+	kickChan     chan struct{}
+	stopChan     chan struct{}
+	lock         sync.Mutex
+	pending      *catalog.ServicesState
+	firstPending time.Time
+	lastTrigger  time.Time
+	lastRun      time.Time
+}
+
+// Return a Scheduler that will call update with the latest state
+func NewScheduler(update func(state *catalog.ServicesState), clock Clock) *Scheduler {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	return &Scheduler{
+		clock:    clock,
+		update:   update,
+		kickChan: make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// NewScheduler returns a Scheduler configured with the reload settings from
+// this HAproxy's config.
+func (h *HAproxy) NewScheduler(update func(state *catalog.ServicesState)) *Scheduler {
+	s := NewScheduler(update, nil)
+	s.Debounce = h.ReloadDebounce.Duration
+	s.MinInterval = h.ReloadMinInterval.Duration
+	s.MaxDelay = h.ReloadMaxDelay.Duration
+
+	return s
+}
+
+// Trigger records that there is a new state to apply. It never blocks.
+func (s *Scheduler) Trigger(state *catalog.ServicesState) {
+	s.lock.Lock()
+	now := s.clock.Now()
+	if s.pending == nil {
+		s.firstPending = now
+	}
+	s.pending = state
+	s.lastTrigger = now
+	s.lock.Unlock()
+
+	select {
+	case s.kickChan <- struct{}{}:
+	default: // Already kicked
+	}
+}
+
+// The time at which the pending update should be applied. Must be called
+// with the lock held.
+func (s *Scheduler) nextRun() time.Time {
+	at := s.lastTrigger.Add(s.Debounce)
+
+	if s.MaxDelay > 0 {
+		if limit := s.firstPending.Add(s.MaxDelay); limit.Before(at) {
+			at = limit
+		}
+	}
+
+	if !s.lastRun.IsZero() {
+		if earliest := s.lastRun.Add(s.MinInterval); at.Before(earliest) {
+			at = earliest
+		}
+	}
+
+	return at
+}
+
+// Block until the pending update is due. Returns false if we were stopped.
+func (s *Scheduler) waitForNextRun() bool {
+	for {
+		s.lock.Lock()
+		if s.pending == nil {
+			s.lock.Unlock()
+			return true
+		}
+		wait := s.nextRun().Sub(s.clock.Now())
+		s.lock.Unlock()
+
+		if wait <= 0 {
+			return true
+		}
+
+		select {
+		case <-s.kickChan: // Something new arrived, work it out again
+		case <-s.clock.After(wait):
+		case <-s.stopChan:
+			return false
+		}
+	}
+}
+
+// Run processes triggered updates until Stop() is called. It is a blocking call.
+func (s *Scheduler) Run(looper director.Looper) {
+	looper.Loop(func() error {
+		select {
+		case <-s.kickChan:
+		case <-s.stopChan:
+			return errSchedulerStopped
+		}
+
+		if !s.waitForNextRun() {
+			return errSchedulerStopped
+		}
+
+		s.lock.Lock()
+		state := s.pending
+		s.pending = nil
+		s.lastRun = s.clock.Now()
+		s.lock.Unlock()
+
+		if state == nil {
+			return nil
+		}
+
+		log.Debug("Scheduler running update")
+		s.update(state)
+
+		return nil
+	})
+}
+
+// Stop makes Run() return at the next opportunity. Pending updates are dropped.
+func (s *Scheduler) Stop() {
+	close(s.stopChan)
+}
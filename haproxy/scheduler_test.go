@@ -0,0 +1,150 @@
+package haproxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// A Clock that only moves when we tell it to
+type fakeClock struct {
+	now     time.Time
+	waiters []fakeWaiter
+	lock    sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	var remaining []fakeWaiter
+	for _, w := range c.waiters {
+		if !w.at.After(c.now) {
+			w.ch <- c.now
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	c.waiters = remaining
+}
+
+// Block until someone is waiting on the clock
+func (c *fakeClock) WaitForWaiters() {
+	for {
+		c.lock.Lock()
+		count := len(c.waiters)
+		c.lock.Unlock()
+		if count > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_Scheduler(t *testing.T) {
+	Convey("Scheduler", t, func() {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		start := clock.Now()
+
+		var updates []*catalog.ServicesState
+		updateChan := make(chan struct{}, 10)
+		scheduler := NewScheduler(func(state *catalog.ServicesState) {
+			updates = append(updates, state)
+			updateChan <- struct{}{}
+		}, clock)
+		scheduler.Debounce = 100 * time.Millisecond
+		scheduler.MaxDelay = 250 * time.Millisecond
+		scheduler.MinInterval = 1 * time.Second
+
+		Convey("nextRun() waits out the debounce window after the last trigger", func() {
+			scheduler.Trigger(catalog.NewServicesState())
+			clock.Advance(50 * time.Millisecond)
+			scheduler.Trigger(catalog.NewServicesState())
+
+			So(scheduler.nextRun(), ShouldResemble, start.Add(150*time.Millisecond))
+		})
+
+		Convey("nextRun() never holds an update past the max delay", func() {
+			for i := 0; i < 5; i++ {
+				scheduler.Trigger(catalog.NewServicesState())
+				clock.Advance(75 * time.Millisecond)
+			}
+
+			So(scheduler.nextRun(), ShouldResemble, start.Add(250*time.Millisecond))
+		})
+
+		Convey("nextRun() respects the minimum interval between runs", func() {
+			scheduler.lastRun = start
+			clock.Advance(10 * time.Millisecond)
+			scheduler.Trigger(catalog.NewServicesState())
+
+			So(scheduler.nextRun(), ShouldResemble, start.Add(1*time.Second))
+		})
+
+		Convey("Run() coalesces a burst into one update with the latest state", func() {
+			first := catalog.NewServicesState()
+			last := catalog.NewServicesState()
+
+			scheduler.Trigger(first)
+			scheduler.Trigger(catalog.NewServicesState())
+			scheduler.Trigger(last)
+
+			go scheduler.Run(director.NewFreeLooper(1, nil))
+
+			clock.WaitForWaiters()
+			clock.Advance(100 * time.Millisecond)
+
+			select {
+			case <-updateChan:
+			case <-time.After(1 * time.Second):
+				panic("Timed out waiting for the scheduler")
+			}
+
+			So(len(updates), ShouldEqual, 1)
+			So(updates[0], ShouldEqual, last)
+		})
+
+		Convey("Run() returns when stopped", func() {
+			done := make(chan struct{})
+			go func() {
+				scheduler.Run(director.NewFreeLooper(director.FOREVER, nil))
+				close(done)
+			}()
+
+			scheduler.Stop()
+
+			select {
+			case <-done:
+			case <-time.After(1 * time.Second):
+				panic("Timed out waiting for the scheduler to stop")
+			}
+
+			So(updates, ShouldBeEmpty)
+		})
+	})
+}
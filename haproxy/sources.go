@@ -0,0 +1,88 @@
+package haproxy
+
+import (
+	"sort"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// The key for a service instance in the sources map
+func sourceKey(hostname string, id string) string {
+	return hostname + "/" + id
+}
+
+// MergeStates combines the states from several named Sidecar sources into one
+// and returns which source each service instance came from. Sources are
+// merged in name order, so if two of them have the same instance, the last
+// one wins.
+func MergeStates(states map[string]*catalog.ServicesState) (*catalog.ServicesState, map[string]string) {
+	merged := catalog.NewServicesState()
+	sources := make(map[string]string)
+
+	var names []string
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		state := states[name]
+		if state == nil {
+			continue
+		}
+
+		state.RLock()
+		if state.LastChanged.After(merged.LastChanged) {
+			merged.LastChanged = state.LastChanged
+		}
+
+		for hostname, server := range state.Servers {
+			mergedServer, ok := merged.Servers[hostname]
+			if !ok {
+				mergedServer = catalog.NewServer(hostname)
+				merged.Servers[hostname] = mergedServer
+			}
+
+			if server.LastUpdated.After(mergedServer.LastUpdated) {
+				mergedServer.LastUpdated = server.LastUpdated
+			}
+			if server.LastChanged.After(mergedServer.LastChanged) {
+				mergedServer.LastChanged = server.LastChanged
+			}
+
+			for id, svc := range server.Services {
+				key := sourceKey(hostname, id)
+				if previous, ok := sources[key]; ok {
+					log.Warnf("Service %s on %s is in both sources '%s' and '%s', using '%s'",
+						id, hostname, previous, name, name)
+				}
+
+				svcCopy := *svc
+				mergedServer.Services[id] = &svcCopy
+				sources[key] = name
+			}
+		}
+		state.RUnlock()
+	}
+
+	return merged, sources
+}
+
+// SetSources records which source each service instance came from, as
+// returned by MergeStates, for templates to look up with sourceFor
+func (h *HAproxy) SetSources(sources map[string]string) {
+	h.sourcesLock.Lock()
+	defer h.sourcesLock.Unlock()
+
+	h.sources = sources
+}
+
+// The name of the source a service instance came from, or "" if we don't know
+func (h *HAproxy) sourceFor(svc *service.Service) string {
+	h.sourcesLock.RLock()
+	defer h.sourcesLock.RUnlock()
+
+	return h.sources[sourceKey(svc.Hostname, svc.ID)]
+}
@@ -0,0 +1,75 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MergeStates(t *testing.T) {
+	Convey("MergeStates()", t, func() {
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		staging := catalog.NewServicesState()
+		staging.AddServiceEntry(service.Service{
+			ID: "deadbeef123", Name: "awesome-svc", Hostname: "staging1",
+			Updated: baseTime, Status: service.ALIVE,
+			Ports: []service.Port{{Type: "tcp", Port: 10000, ServicePort: 8080, IP: "10.0.0.1"}},
+		})
+		staging.LastChanged = baseTime
+
+		prod := catalog.NewServicesState()
+		prod.AddServiceEntry(service.Service{
+			ID: "deadbeef456", Name: "awesome-svc", Hostname: "prod1",
+			Updated: baseTime, Status: service.ALIVE,
+			Ports: []service.Port{{Type: "tcp", Port: 10001, ServicePort: 8080, IP: "10.1.0.1"}},
+		})
+		prod.LastChanged = baseTime.Add(time.Minute)
+
+		merged, sources := MergeStates(map[string]*catalog.ServicesState{
+			"staging":   staging,
+			"prod-east": prod,
+			"empty":     nil,
+		})
+
+		Convey("includes the servers from every source", func() {
+			So(merged.HasServer("staging1"), ShouldBeTrue)
+			So(merged.HasServer("prod1"), ShouldBeTrue)
+			So(merged.LastChanged, ShouldEqual, prod.LastChanged)
+			So(merged.ByService()["awesome-svc"], ShouldHaveLength, 2)
+		})
+
+		Convey("records the source of each instance", func() {
+			So(sources, ShouldResemble, map[string]string{
+				"staging1/deadbeef123": "staging",
+				"prod1/deadbeef456":    "prod-east",
+			})
+		})
+
+		Convey("makes sourceFor available to templates", func() {
+			tmpDir, _ := ioutil.TempDir("", "sources")
+			defer os.RemoveAll(tmpDir)
+
+			proxy := New(tmpDir+"/haproxy.cfg", tmpDir+"/haproxy.pid")
+			proxy.Template = tmpDir + "/template.cfg"
+			ioutil.WriteFile(proxy.Template, []byte(
+				"{{ range $svcName, $svcs := .Services }}{{ range $svc := $svcs }}"+
+					"{{ $svc.Hostname }}={{ sourceFor $svc }}\n{{ end }}{{ end }}",
+			), 0644)
+			proxy.SetSources(sources)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 256))
+			err := proxy.WriteConfig(merged, buf)
+
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "staging1=staging\n")
+			So(buf.String(), ShouldContainSubstring, "prod1=prod-east\n")
+		})
+	})
+}
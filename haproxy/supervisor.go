@@ -0,0 +1,251 @@
+package haproxy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMinBackoff = 1 * time.Second
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+var errSupervisorStopped = errors.New("supervisor stopped")
+
+// SupervisorStatus describes the HAproxy process we are supervising
+type SupervisorStatus struct {
+	Running   bool      `json:"running"`
+	Pid       int       `json:"pid,omitempty"`
+	Restarts  int       `json:"restarts"`
+	LastExit  string    `json:"last_exit,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// A Supervisor runs a command in the foreground as our child, sends its output
+// to our logs, and starts it again if it exits. Restarts back off from
+// MinBackoff up to MaxBackoff, and the backoff is reset once the process has
+// stayed up for longer than MaxBackoff.
+type Supervisor struct {
+	Command    string
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	lock      sync.Mutex
+	cmd       *exec.Cmd
+	exited    chan error
+	running   bool
+	restarts  int
+	lastExit  error
+	startedAt time.Time
+	backoff   time.Duration
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+// Return a Supervisor for the command, which is run with bash
+func NewSupervisor(command string) *Supervisor {
+	return &Supervisor{
+		Command:    command,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Start launches the process and then supervises it on the looper in the
+// background. Only the first launch's error is returned, later ones are
+// retried with backoff.
+func (s *Supervisor) Start(looper director.Looper) error {
+	err := s.launch()
+	if err != nil {
+		return err
+	}
+
+	go s.Run(looper)
+	return nil
+}
+
+// Start the command, with stdout and stderr going to our logs
+func (s *Supervisor) launch() error {
+	// exec so that signals go straight to the process rather than bash
+	cmd := exec.Command("/bin/bash", "-c", "exec "+s.Command)
+	logger := log.WithField("process", "haproxy")
+	stdout := logger.WriterLevel(log.InfoLevel)
+	stderr := logger.WriterLevel(log.WarnLevel)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Start()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return fmt.Errorf("Unable to start '%s': %s", s.Command, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		stdout.Close()
+		stderr.Close()
+		exited <- err
+	}()
+
+	s.lock.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.running = true
+	s.startedAt = time.Now().UTC()
+	s.lock.Unlock()
+
+	log.Infof("Started HAproxy with pid %d", cmd.Process.Pid)
+	return nil
+}
+
+// Run waits for the process to exit and starts it again, until Stop() is
+// called. It is a blocking call.
+func (s *Supervisor) Run(looper director.Looper) {
+	looper.Loop(func() error {
+		s.lock.Lock()
+		cmd, exited := s.cmd, s.exited
+		s.lock.Unlock()
+
+		if cmd != nil {
+			err := <-exited
+			if err == nil {
+				err = fmt.Errorf("exited cleanly")
+			}
+
+			s.lock.Lock()
+			s.running = false
+			s.lastExit = err
+			upFor := time.Since(s.startedAt)
+			s.lock.Unlock()
+
+			select {
+			case <-s.stopChan:
+				return errSupervisorStopped
+			default:
+			}
+
+			log.Errorf("HAproxy (pid %d) exited after %s: %s", cmd.Process.Pid, upFor, err)
+			s.updateBackoff(upFor)
+		}
+
+		s.lock.Lock()
+		wait := s.backoff
+		s.lock.Unlock()
+
+		select {
+		case <-s.stopChan:
+			return errSupervisorStopped
+		case <-time.After(wait):
+		}
+
+		s.lock.Lock()
+		s.restarts++
+		s.lock.Unlock()
+		haproxyRestartsTotal.Inc()
+
+		if err := s.launch(); err != nil {
+			log.Errorf("Failed to restart HAproxy: %s", err)
+			s.lock.Lock()
+			s.cmd = nil
+			s.lastExit = err
+			s.lock.Unlock()
+			s.updateBackoff(0)
+		}
+
+		return nil
+	})
+}
+
+// Double the backoff after a quick failure, or reset it if the process had
+// been up for a while
+func (s *Supervisor) updateBackoff(upFor time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case upFor > s.MaxBackoff || s.backoff == 0:
+		s.backoff = s.MinBackoff
+	case s.backoff*2 > s.MaxBackoff:
+		s.backoff = s.MaxBackoff
+	default:
+		s.backoff *= 2
+	}
+}
+
+// Stop stops supervising and terminates the process
+func (s *Supervisor) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cmd != nil && s.running {
+		s.cmd.Process.Signal(syscall.SIGTERM)
+	}
+}
+
+// StopAndWait stops supervising, terminates the process, and waits up to
+// timeout for it to exit. Returns false if it's still running.
+func (s *Supervisor) StopAndWait(timeout time.Duration) bool {
+	s.Stop()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		s.lock.Lock()
+		running := s.running
+		s.lock.Unlock()
+
+		if !running {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Reload signals the process to reload its config. HAproxy in master-worker
+// mode does this on SIGUSR2.
+func (s *Supervisor) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cmd == nil || !s.running {
+		return fmt.Errorf("HAproxy is not running")
+	}
+
+	return s.cmd.Process.Signal(syscall.SIGUSR2)
+}
+
+// Status reports on the supervised process
+func (s *Supervisor) Status() *SupervisorStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := &SupervisorStatus{
+		Running:   s.running,
+		Restarts:  s.restarts,
+		StartedAt: s.startedAt,
+	}
+
+	if s.running {
+		status.Pid = s.cmd.Process.Pid
+	}
+
+	if s.lastExit != nil {
+		status.LastExit = s.lastExit.Error()
+	}
+
+	return status
+}
@@ -0,0 +1,101 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Poll until the condition is true, or give up after a second
+func eventually(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func Test_Supervisor(t *testing.T) {
+	Convey("Supervisor", t, func() {
+		Convey("restarts the process when it exits", func() {
+			supervisor := NewSupervisor("/bin/sleep 0.05")
+			supervisor.MinBackoff = 10 * time.Millisecond
+			supervisor.MaxBackoff = 20 * time.Millisecond
+
+			err := supervisor.Start(director.NewFreeLooper(director.FOREVER, nil))
+			So(err, ShouldBeNil)
+
+			restarted := eventually(func() bool { return supervisor.Status().Restarts >= 2 })
+			// Stopping it can kill the running process, which replaces LastExit
+			lastExit := supervisor.Status().LastExit
+			supervisor.Stop()
+
+			So(restarted, ShouldBeTrue)
+			So(lastExit, ShouldEqual, "exited cleanly")
+		})
+
+		Convey("reports the running process and stops it", func() {
+			supervisor := NewSupervisor("/bin/sleep 10")
+
+			done := make(chan struct{})
+			err := supervisor.launch()
+			go func() {
+				supervisor.Run(director.NewFreeLooper(director.FOREVER, nil))
+				close(done)
+			}()
+
+			So(err, ShouldBeNil)
+			status := supervisor.Status()
+			So(status.Running, ShouldBeTrue)
+			So(status.Pid, ShouldBeGreaterThan, 0)
+			So(status.Restarts, ShouldEqual, 0)
+
+			supervisor.Stop()
+
+			select {
+			case <-done:
+			case <-time.After(1 * time.Second):
+				panic("Timed out waiting for the supervisor to stop")
+			}
+			So(supervisor.Status().Running, ShouldBeFalse)
+		})
+
+		Convey("StopAndWait() waits for the process to exit", func() {
+			supervisor := NewSupervisor("/bin/sleep 10")
+
+			err := supervisor.Start(director.NewFreeLooper(director.FOREVER, nil))
+			So(err, ShouldBeNil)
+
+			So(supervisor.StopAndWait(1*time.Second), ShouldBeTrue)
+			So(supervisor.Status().Running, ShouldBeFalse)
+		})
+
+		Convey("Reload() fails when the process isn't running", func() {
+			supervisor := NewSupervisor("/bin/sleep 10")
+			So(supervisor.Reload(), ShouldNotBeNil)
+		})
+
+		Convey("backs off exponentially up to the max", func() {
+			supervisor := NewSupervisor("")
+			supervisor.MinBackoff = 1 * time.Second
+			supervisor.MaxBackoff = 5 * time.Second
+
+			var backoffs []time.Duration
+			for i := 0; i < 5; i++ {
+				supervisor.updateBackoff(0)
+				backoffs = append(backoffs, supervisor.backoff)
+			}
+			So(backoffs, ShouldResemble, []time.Duration{
+				1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+			})
+
+			// A process that stayed up for a while starts over
+			supervisor.updateBackoff(1 * time.Minute)
+			So(supervisor.backoff, ShouldEqual, 1*time.Second)
+		})
+	})
+}
@@ -0,0 +1,163 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// An Output is an extra file rendered from its own template alongside the
+// main config on every update, e.g. map files or certificate lists. All
+// outputs are rendered from the same state and applied together.
+type Output struct {
+	Template string `toml:"template"`
+	File     string `toml:"file"`
+}
+
+// A parsed template and the modification time of the file it came from
+type loadedTemplate struct {
+	template *template.Template
+	modTime  time.Time
+}
+
+// All of the template/file pairs we render, with the main config first
+func (h *HAproxy) outputs() []Output {
+	outputs := []Output{{Template: h.Template, File: h.ConfigFile}}
+	extras := h.Outputs
+	if vhostsMap := h.Vhosts.output(); vhostsMap != nil {
+		extras = append(extras[:len(extras):len(extras)], *vhostsMap)
+	}
+
+	for _, output := range extras {
+		if output.File == h.ConfigFile {
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+
+	return outputs
+}
+
+// Parse a single template file
+func (h *HAproxy) parseTemplateFile(path string) (*loadedTemplate, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error Parsing template '%s': %s", path, err.Error())
+	}
+
+	t, err := template.New("haproxy").Funcs(h.templateFuncs(nil, nil, nil)).ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error Parsing template '%s': %s", path, err.Error())
+	}
+
+	return &loadedTemplate{template: t, modTime: stat.ModTime()}, nil
+}
+
+// LoadTemplate parses all of the template files and keeps them for
+// rendering. If any of them fails to parse, the previously loaded set is
+// kept and an error is returned.
+func (h *HAproxy) LoadTemplate() error {
+	loaded := make(map[string]*loadedTemplate)
+	for _, output := range h.outputs() {
+		t, err := h.parseTemplateFile(output.Template)
+		if err != nil {
+			h.markTemplatesSeen()
+			return err
+		}
+		loaded[output.Template] = t
+	}
+
+	h.templateLock.Lock()
+	h.templates = loaded
+	h.templateLock.Unlock()
+
+	h.markTemplatesSeen()
+	return nil
+}
+
+// Return the parsed template for path, loading it first if we haven't yet
+func (h *HAproxy) getTemplate(path string) (*template.Template, error) {
+	h.templateLock.RLock()
+	loaded, ok := h.templates[path]
+	h.templateLock.RUnlock()
+
+	if ok {
+		return loaded.template, nil
+	}
+
+	loaded, err := h.parseTemplateFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h.templateLock.Lock()
+	if h.templates == nil {
+		h.templates = make(map[string]*loadedTemplate)
+	}
+	h.templates[path] = loaded
+	h.templateLock.Unlock()
+
+	return loaded.template, nil
+}
+
+// Record the current modification times of the template files so that we
+// only try to reload them when they change again
+func (h *HAproxy) markTemplatesSeen() {
+	seen := make(map[string]time.Time)
+	for _, output := range h.outputs() {
+		if stat, err := os.Stat(output.Template); err == nil {
+			seen[output.Template] = stat.ModTime()
+		}
+	}
+
+	h.templateLock.Lock()
+	h.templatesSeen = seen
+	h.templateLock.Unlock()
+}
+
+// Returns true if any template file on disk has changed since we last looked
+func (h *HAproxy) templateChanged() bool {
+	h.templateLock.RLock()
+	defer h.templateLock.RUnlock()
+
+	for _, output := range h.outputs() {
+		stat, err := os.Stat(output.Template)
+		if err != nil {
+			continue
+		}
+
+		if !stat.ModTime().Equal(h.templatesSeen[output.Template]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WatchTemplate checks the template files on each iteration of the looper and
+// re-parses them when they have changed on disk. onChange is called after the
+// new templates have been loaded successfully. If one fails to parse, we log
+// the error and keep rendering with the old ones. This is a blocking call.
+func (h *HAproxy) WatchTemplate(looper director.Looper, onChange func()) {
+	looper.Loop(func() error {
+		if !h.templateChanged() {
+			return nil
+		}
+
+		log.Info("Templates changed on disk, reloading them")
+		if err := h.LoadTemplate(); err != nil {
+			log.Errorf("Keeping previous templates: %s", err)
+			return nil
+		}
+
+		if onChange != nil {
+			onChange()
+		}
+
+		return nil
+	})
+}
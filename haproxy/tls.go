@@ -0,0 +1,155 @@
+package haproxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTLSPort = 443
+)
+
+// TLSConfig enables an HTTPS frontend for HTTP-mode services. Certificates are
+// PEM bundles (cert, chain and key) in CertDir, named <hostname>.pem. Services
+// maps each service name to the hostnames it answers to, which are used to
+// pick its certificates and to route requests to it by SNI.
+type TLSConfig struct {
+	CertDir  string              `toml:"cert_dir"`
+	BindPort int                 `toml:"bind_port"`
+	Services map[string][]string `toml:"services"`
+
+	seenLock sync.Mutex
+	seen     string
+}
+
+// The port the HTTPS frontend binds to
+func (t *TLSConfig) port() int {
+	if t == nil || t.BindPort == 0 {
+		return DefaultTLSPort
+	}
+
+	return t.BindPort
+}
+
+// The hostnames configured for a service
+func (t *TLSConfig) hostnamesFor(svcName string) []string {
+	if t == nil {
+		return nil
+	}
+
+	return t.Services[svcName]
+}
+
+// The certificate files for a service's hostnames that exist in CertDir
+func (t *TLSConfig) certsFor(svcName string) []string {
+	var certs []string
+	for _, hostname := range t.hostnamesFor(svcName) {
+		path := filepath.Join(t.CertDir, hostname+".pem")
+		if fileExists(path) {
+			certs = append(certs, path)
+		}
+	}
+
+	return certs
+}
+
+// A hash of every certificate in CertDir, so that we notice when one is
+// added, removed, or renewed even though the rendered config stays the same
+func (t *TLSConfig) certsHash() string {
+	if t == nil || t.CertDir == "" {
+		return ""
+	}
+
+	paths, err := filepath.Glob(filepath.Join(t.CertDir, "*.pem"))
+	if err != nil {
+		return ""
+	}
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Warnf("Unable to read certificate %s: %s", path, err)
+			continue
+		}
+		fmt.Fprintf(hash, "%s\n", path)
+		hash.Write(data)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// Whether a service should be served over HTTPS. It has to be configured for
+// TLS, be an HTTP-mode service, have a TCP port, and have at least one
+// certificate.
+func (h *HAproxy) hasTLS(svcName string, modes map[string]string, ports portmap) bool {
+	if h.TLS == nil || modes[svcName] != "http" {
+		return false
+	}
+
+	return primaryPort(ports, svcName) != "" && len(h.TLS.certsFor(svcName)) > 0
+}
+
+// The lowest TCP ServicePort of a service. This is the backend that HTTPS
+// requests for the service are sent to.
+func primaryPort(ports portmap, svcName string) string {
+	var lowest int
+	for svcPort := range ports[svcName]["tcp"] {
+		port, err := strconv.Atoi(svcPort)
+		if err == nil && (lowest == 0 || port < lowest) {
+			lowest = port
+		}
+	}
+
+	if lowest == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(lowest)
+}
+
+// WatchCerts checks the TLS certificate directory on each iteration of the
+// looper and calls onChange when any certificate has been added, removed, or
+// changed. This is a blocking call.
+func (h *HAproxy) WatchCerts(looper director.Looper, onChange func()) {
+	if h.TLS == nil || h.TLS.CertDir == "" {
+		return
+	}
+
+	if _, err := os.Stat(h.TLS.CertDir); err != nil {
+		log.Warnf("TLS certificate directory is not usable: %s", err)
+	}
+
+	tls := h.TLS
+	tls.seenLock.Lock()
+	tls.seen = tls.certsHash()
+	tls.seenLock.Unlock()
+
+	looper.Loop(func() error {
+		hash := tls.certsHash()
+
+		tls.seenLock.Lock()
+		changed := hash != tls.seen
+		tls.seen = hash
+		tls.seenLock.Unlock()
+
+		if changed {
+			log.Info("TLS certificates changed on disk")
+			if onChange != nil {
+				onChange()
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+package haproxy
+
+import (
+	"strings"
+)
+
+const (
+	DefaultVhostPort = 80
+)
+
+// VhostsConfig enables a shared HTTP frontend that routes requests to
+// HTTP-mode services by their Host header. Services maps each service name
+// to its hostnames. When MapFile and MapTemplate are set, the routing is
+// rendered into an HAproxy map file alongside the config, otherwise the
+// template writes ACLs inline.
+type VhostsConfig struct {
+	BindPort    int                 `toml:"bind_port"`
+	MapFile     string              `toml:"map_file"`
+	MapTemplate string              `toml:"map_template"`
+	Services    map[string][]string `toml:"services"`
+}
+
+// The port the shared frontend binds to
+func (v *VhostsConfig) port() int {
+	if v == nil || v.BindPort == 0 {
+		return DefaultVhostPort
+	}
+
+	return v.BindPort
+}
+
+// The map file the frontend looks backends up in, or "" to use ACLs
+func (v *VhostsConfig) mapFile() string {
+	if v == nil || v.MapTemplate == "" {
+		return ""
+	}
+
+	return v.MapFile
+}
+
+// The hostnames for a service, lowercased to match how the frontend
+// normalizes the Host header
+func (v *VhostsConfig) hostnamesFor(svcName string) []string {
+	if v == nil {
+		return nil
+	}
+
+	var hostnames []string
+	for _, hostname := range v.Services[svcName] {
+		hostnames = append(hostnames, strings.ToLower(hostname))
+	}
+
+	return hostnames
+}
+
+// The map file as an extra Output, if we're using one
+func (v *VhostsConfig) output() *Output {
+	if v.mapFile() == "" {
+		return nil
+	}
+
+	return &Output{Template: v.MapTemplate, File: v.MapFile}
+}
+
+// Whether a service should be routed to by Host header. It has to have
+// hostnames configured, be an HTTP-mode service, and have a TCP port.
+func (h *HAproxy) hasVhost(svcName string, modes map[string]string, ports portmap) bool {
+	if len(h.Vhosts.hostnamesFor(svcName)) < 1 || modes[svcName] != "http" {
+		return false
+	}
+
+	return primaryPort(ports, svcName) != ""
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/receiver"
 	"github.com/Nitro/sidecar/service"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,25 +23,38 @@ type ApiErrors struct {
 	Errors []string `json:"errors"`
 }
 
+// HealthErrors is what /health returns when something is wrong, along with
+// the status that helps find out what
+type HealthErrors struct {
+	ApiErrors
+	Supervisor *haproxy.SupervisorStatus `json:"supervisor,omitempty"`
+	Sources    map[string]SourceStatus   `json:"sources"`
+	Following  *FollowStatus             `json:"following,omitempty"`
+}
+
 type ApiStatus struct {
-	Message        string           `json:"message"`
-	LastChanged    time.Time        `json:"last_changed"`
-	ServiceChanged *service.Service `json:"last_service_changed"`
+	Message        string                    `json:"message"`
+	LastChanged    time.Time                 `json:"last_changed"`
+	ServiceChanged *service.Service          `json:"last_service_changed"`
+	Supervisor     *haproxy.SupervisorStatus `json:"supervisor,omitempty"`
+	Sources        map[string]SourceStatus   `json:"sources"`
+	Following      *FollowStatus             `json:"following,omitempty"`
 }
 
 // The health check endpoint. Tells us if HAproxy is running and has
 // been properly configured. Since this is critical infrastructure this
 // helps make sure a host is not "down" by havign the proxy down.
-func healthHandler(response http.ResponseWriter, req *http.Request, rcvr *receiver.Receiver) {
+func healthHandler(response http.ResponseWriter, req *http.Request, sources *SourceSet) {
 	defer req.Body.Close()
+	rcvr := sources.Merged
 	response.Header().Set("Content-Type", "application/json")
 
 	errors := make([]string, 0)
 
 	// Do we have an HAproxy instance running?
-	err := run("test -f " + proxy.PidFile + " && ps aux `cat " + proxy.PidFile + "`")
+	err := proxy.CheckRunning()
 	if err != nil {
-		errors = append(errors, "No HAproxy running!")
+		errors = append(errors, "No HAproxy running! "+err.Error())
 	}
 
 	rcvr.StateLock.Lock()
@@ -47,9 +65,19 @@ func healthHandler(response http.ResponseWriter, req *http.Request, rcvr *receiv
 		errors = append(errors, "Last attempted HAproxy config write failed!")
 	}
 
+	var following *FollowStatus
+	if watcher != nil {
+		following = watcher.Status()
+	}
+
 	// Umm, crap, something went wrong.
 	if errors != nil && len(errors) != 0 {
-		message, _ := json.Marshal(ApiErrors{errors})
+		message, _ := json.Marshal(HealthErrors{
+			ApiErrors:  ApiErrors{errors},
+			Supervisor: proxy.SupervisorStatus(),
+			Sources:    sources.Status(),
+			Following:  following,
+		})
 		response.WriteHeader(http.StatusInternalServerError)
 		response.Write(message)
 		return
@@ -64,6 +92,9 @@ func healthHandler(response http.ResponseWriter, req *http.Request, rcvr *receiv
 		Message:        "Healthy!",
 		LastChanged:    lastChanged,
 		ServiceChanged: rcvr.LastSvcChanged,
+		Supervisor:     proxy.SupervisorStatus(),
+		Sources:        sources.Status(),
+		Following:      following,
 	})
 
 	response.Write(message)
@@ -84,6 +115,130 @@ func stateHandler(response http.ResponseWriter, req *http.Request, rcvr *receive
 	response.Write(rcvr.CurrentState.Encode())
 }
 
+// Returns how the instances of each service were grouped by the ServicePorts
+// they expose. Instances with different ports are all kept, and each port is
+// served by the instances that expose it.
+func portGroupsHandler(response http.ResponseWriter, req *http.Request, rcvr *receiver.Receiver) {
+	defer req.Body.Close()
+	response.Header().Set("Content-Type", "application/json")
+
+	rcvr.StateLock.Lock()
+	state := rcvr.CurrentState
+	rcvr.StateLock.Unlock()
+
+	if state == nil {
+		message, _ := json.Marshal(ApiErrors{[]string{"No currently stored state"}})
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write(message)
+		return
+	}
+
+	message, _ := json.Marshal(haproxy.PortGroups(state))
+	response.Write(message)
+}
+
+// Returns the HAproxy config that was last applied, as plain text
+func configHandler(response http.ResponseWriter, req *http.Request, rcvr *receiver.Receiver) {
+	defer req.Body.Close()
+
+	config, err := proxy.CurrentConfig()
+	if err != nil {
+		response.Header().Set("Content-Type", "application/json")
+		message, _ := json.Marshal(ApiErrors{[]string{err.Error()}})
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write(message)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/plain")
+	response.Write(config)
+}
+
+// Returns a unified diff between the last two configs applied to HAproxy
+func configDiffHandler(response http.ResponseWriter, req *http.Request, rcvr *receiver.Receiver) {
+	defer req.Body.Close()
+
+	diff, err := proxy.ConfigDiff()
+	if err != nil {
+		response.Header().Set("Content-Type", "application/json")
+		message, _ := json.Marshal(ApiErrors{[]string{err.Error()}})
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write(message)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/plain")
+	response.Write([]byte(diff))
+}
+
+// Renders a state POSTed in the same encoding as /update and reports what
+// applying it would do, without touching the live config
+func previewHandler(response http.ResponseWriter, req *http.Request, rcvr *receiver.Receiver) {
+	defer req.Body.Close()
+	response.Header().Set("Content-Type", "application/json")
+
+	state, err := decodePreviewState(req.Body)
+	if err != nil {
+		message, _ := json.Marshal(ApiErrors{[]string{err.Error()}})
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write(message)
+		return
+	}
+
+	preview, err := proxy.Preview(state)
+	if err != nil {
+		message, _ := json.Marshal(ApiErrors{[]string{err.Error()}})
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write(message)
+		return
+	}
+
+	message, _ := json.Marshal(preview)
+	response.Write(message)
+}
+
+// Accepts either a StateChangedEvent, like /update, or a bare ServicesState
+func decodePreviewState(body io.Reader) (*catalog.ServicesState, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var evt catalog.StateChangedEvent
+	err = json.Unmarshal(data, &evt)
+	if err == nil && evt.State != nil {
+		return evt.State, nil
+	}
+
+	state, err := catalog.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode state: %s", err)
+	}
+
+	return state, nil
+}
+
+// Counts each update POSTed to us before handing it to the receiver for the
+// source. Updates to /update go to the first source.
+func updateHandler(response http.ResponseWriter, req *http.Request, sources *SourceSet) {
+	source := sources.Default()
+	if name, ok := mux.Vars(req)["source"]; ok {
+		source = sources.Get(name)
+	}
+
+	if source == nil {
+		defer req.Body.Close()
+		response.Header().Set("Content-Type", "application/json")
+		message, _ := json.Marshal(ApiErrors{[]string{"No such source"}})
+		response.WriteHeader(http.StatusNotFound)
+		response.Write(message)
+		return
+	}
+
+	updatesReceivedTotal.Inc()
+	receiver.UpdateHandler(response, req, source.Receiver)
+}
+
 // Wrap a handler that needs a receiver into a standard http.HandlerFunc
 func wrapHandler(handler func(http.ResponseWriter, *http.Request, *receiver.Receiver), rcvr *receiver.Receiver) http.HandlerFunc {
 	return func(response http.ResponseWriter, req *http.Request) {
@@ -91,21 +246,39 @@ func wrapHandler(handler func(http.ResponseWriter, *http.Request, *receiver.Rece
 	}
 }
 
+// Wrap a handler that needs the sources into a standard http.HandlerFunc
+func wrapSourcesHandler(handler func(http.ResponseWriter, *http.Request, *SourceSet), sources *SourceSet) http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		handler(response, req, sources)
+	}
+}
+
 // Start the HTTP server and begin handling requests. This is a
 // blocking call.
-func serveHttp(listenIp string, listenPort int, rcvr *receiver.Receiver) {
+func serveHttp(listenIp string, listenPort int, sources *SourceSet) {
+	rcvr := sources.Merged
 	listenStr := fmt.Sprintf("%s:%d", listenIp, listenPort)
 
 	log.Infof("Starting up on %s", listenStr)
 	router := mux.NewRouter()
 
-	updateWrapped := wrapHandler(receiver.UpdateHandler, rcvr)
-	healthWrapped := wrapHandler(healthHandler, rcvr)
+	updateWrapped := wrapSourcesHandler(updateHandler, sources)
+	healthWrapped := wrapSourcesHandler(healthHandler, sources)
 	stateWrapped := wrapHandler(stateHandler, rcvr)
+	portGroupsWrapped := wrapHandler(portGroupsHandler, rcvr)
+	configWrapped := wrapHandler(configHandler, rcvr)
+	configDiffWrapped := wrapHandler(configDiffHandler, rcvr)
+	previewWrapped := wrapHandler(previewHandler, rcvr)
 
 	router.HandleFunc("/update", updateWrapped).Methods("POST")
+	router.HandleFunc("/update/{source}", updateWrapped).Methods("POST")
 	router.HandleFunc("/health", healthWrapped).Methods("GET")
 	router.HandleFunc("/state", stateWrapped).Methods("GET")
+	router.HandleFunc("/port-groups", portGroupsWrapped).Methods("GET")
+	router.HandleFunc("/config", configWrapped).Methods("GET")
+	router.HandleFunc("/config/diff", configDiffWrapped).Methods("GET")
+	router.HandleFunc("/preview", previewWrapped).Methods("POST")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	http.Handle("/", handlers.LoggingHandler(os.Stdout, router))
 
 	err := http.ListenAndServe(listenStr, nil)
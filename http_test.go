@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"net/http/httptest"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/Nitro/haproxy-api/haproxy"
 	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/receiver"
 	"github.com/Nitro/sidecar/service"
+	"github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -80,3 +84,210 @@ func Test_stateHandler(t *testing.T) {
 		})
 	})
 }
+
+func Test_portGroupsHandler(t *testing.T) {
+	Convey("portGroupsHandler()", t, func() {
+		rcvr := &receiver.Receiver{}
+		req := httptest.NewRequest("GET", "/port-groups", nil)
+		recorder := httptest.NewRecorder()
+
+		Convey("returns an error when there is no state", func() {
+			portGroupsHandler(recorder, req, rcvr)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 500)
+		})
+
+		Convey("reports the port groups for each service", func() {
+			state := catalog.NewServicesState()
+			state.AddServiceEntry(service.Service{
+				ID:       "deadbeef123",
+				Name:     "bocaccio",
+				Hostname: "chaucer",
+				Updated:  time.Now().UTC(),
+				Status:   service.ALIVE,
+				Ports:    []service.Port{{Type: "tcp", Port: 10000, ServicePort: 8080}},
+			})
+			state.AddServiceEntry(service.Service{
+				ID:       "deadbeef456",
+				Name:     "bocaccio",
+				Hostname: "chaucer",
+				Updated:  time.Now().UTC(),
+				Status:   service.ALIVE,
+				Ports: []service.Port{
+					{Type: "tcp", Port: 10001, ServicePort: 8080},
+					{Type: "tcp", Port: 10002, ServicePort: 9090},
+				},
+			})
+			rcvr.CurrentState = state
+
+			portGroupsHandler(recorder, req, rcvr)
+
+			resp := recorder.Result()
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+			var groups map[string][]haproxy.PortGroup
+			json.Unmarshal(bodyBytes, &groups)
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(len(groups["bocaccio"]), ShouldEqual, 2)
+			So(groups["bocaccio"][0].Ports, ShouldResemble, []string{"8080"})
+			So(groups["bocaccio"][1].Ports, ShouldResemble, []string{"8080", "9090"})
+		})
+	})
+}
+
+func Test_configHandler(t *testing.T) {
+	Convey("configHandler()", t, func() {
+		rcvr := &receiver.Receiver{}
+		recorder := httptest.NewRecorder()
+
+		tmpDir, _ := ioutil.TempDir("", "configHandler")
+		defer os.RemoveAll(tmpDir)
+
+		// Assign to the :( global
+		proxy = haproxy.New(tmpDir+"/haproxy.cfg", tmpDir+"/haproxy.pid")
+
+		Convey("returns an error when there is no config", func() {
+			configHandler(recorder, httptest.NewRequest("GET", "/config", nil), rcvr)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 500)
+		})
+
+		Convey("falls back to the config on disk", func() {
+			ioutil.WriteFile(tmpDir+"/haproxy.cfg", []byte("global\n\tdaemon\n"), 0644)
+
+			configHandler(recorder, httptest.NewRequest("GET", "/config", nil), rcvr)
+
+			resp := recorder.Result()
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/plain")
+			So(string(bodyBytes), ShouldEqual, "global\n\tdaemon\n")
+		})
+
+		Convey("returns an error from /config/diff until two configs were applied", func() {
+			configDiffHandler(recorder, httptest.NewRequest("GET", "/config/diff", nil), rcvr)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 500)
+		})
+	})
+}
+
+func Test_previewHandler(t *testing.T) {
+	Convey("previewHandler()", t, func() {
+		rcvr := &receiver.Receiver{}
+		recorder := httptest.NewRecorder()
+
+		tmpDir, _ := ioutil.TempDir("", "previewHandler")
+		defer os.RemoveAll(tmpDir)
+
+		// Assign to the :( global
+		proxy = haproxy.New(tmpDir+"/haproxy.cfg", tmpDir+"/haproxy.pid")
+		proxy.VerifyCmd = "/usr/bin/true {{config}}"
+		ioutil.WriteFile(proxy.ConfigFile, []byte("global\n\tdaemon\n"), 0644)
+
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: "chaucer",
+			Updated:  time.Now().UTC(),
+			Status:   service.ALIVE,
+			Ports:    []service.Port{{Type: "tcp", Port: 10000, ServicePort: 8080, IP: "127.0.0.1"}},
+		})
+		evt := catalog.StateChangedEvent{State: state}
+		body, _ := json.Marshal(evt)
+
+		Convey("renders and diffs the state without applying it", func() {
+			req := httptest.NewRequest("POST", "/preview", bytes.NewReader(body))
+			previewHandler(recorder, req, rcvr)
+
+			resp := recorder.Result()
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+			var preview haproxy.Preview
+			json.Unmarshal(bodyBytes, &preview)
+			live, _ := ioutil.ReadFile(proxy.ConfigFile)
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(preview.Config, ShouldContainSubstring, "frontend bocaccio-8080")
+			So(preview.Diff, ShouldContainSubstring, "+frontend bocaccio-8080")
+			So(preview.Errors, ShouldBeEmpty)
+			So(string(live), ShouldEqual, "global\n\tdaemon\n")
+		})
+
+		Convey("reports verify errors", func() {
+			proxy.VerifyCmd = "/usr/bin/false {{config}}"
+
+			req := httptest.NewRequest("POST", "/preview", bytes.NewReader(body))
+			previewHandler(recorder, req, rcvr)
+
+			resp := recorder.Result()
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+			var preview haproxy.Preview
+			json.Unmarshal(bodyBytes, &preview)
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(len(preview.Errors), ShouldEqual, 1)
+		})
+
+		Convey("rejects a body that isn't a state", func() {
+			req := httptest.NewRequest("POST", "/preview", bytes.NewReader([]byte("not json")))
+			previewHandler(recorder, req, rcvr)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 400)
+		})
+	})
+}
+
+func Test_healthHandler(t *testing.T) {
+	Convey("healthHandler()", t, func() {
+		recorder := httptest.NewRecorder()
+		tmpDir, _ := ioutil.TempDir("", "healthHandler")
+		defer os.RemoveAll(tmpDir)
+
+		// Nothing is running from this pid file
+		proxy = haproxy.New(tmpDir+"/haproxy.cfg", tmpDir+"/haproxy.pid")
+
+		merged := &receiver.Receiver{ReloadChan: make(chan time.Time, 10)}
+		sources := NewSourceSet([]SourceConfig{{Name: "staging"}, {Name: "prod-east"}}, merged, nil)
+		sources.update(sources.Get("staging"), catalog.NewServicesState())
+
+		Convey("reports the sources along with the errors", func() {
+			req := httptest.NewRequest("GET", "/health", nil)
+			healthHandler(recorder, req, sources)
+
+			resp := recorder.Result()
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+			var health HealthErrors
+			json.Unmarshal(bodyBytes, &health)
+
+			So(resp.StatusCode, ShouldEqual, 500)
+			So(health.Errors, ShouldNotBeEmpty)
+			So(health.Sources["staging"].HasState, ShouldBeTrue)
+			So(health.Sources["prod-east"].HasState, ShouldBeFalse)
+		})
+
+		Convey("reports which Sidecar we're following along with the errors", func() {
+			// Assign to the :( global
+			watcher = NewSidecarWatcher(exampleTargets, plainSidecar, director.NewFreeLooper(1, nil), nil)
+			defer func() { watcher = nil }()
+
+			req := httptest.NewRequest("GET", "/health", nil)
+			healthHandler(recorder, req, sources)
+
+			resp := recorder.Result()
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+			var health HealthErrors
+			json.Unmarshal(bodyBytes, &health)
+
+			So(resp.StatusCode, ShouldEqual, 500)
+			So(health.Following, ShouldNotBeNil)
+			So(health.Following.Active, ShouldEqual, exampleTargets[0].Address)
+		})
+	})
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"os"
-	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/receiver"
 	"github.com/relistan/go-director"
 	"github.com/relistan/rubberneck"
@@ -14,17 +16,26 @@ import (
 )
 
 const (
-	ReloadBufferSize = 256
+	ReloadBufferSize      = 256
+	TemplateCheckInterval = 5 * time.Second
+	ShutdownTimeout       = 8 * time.Second // Inside the 10s "docker stop" gives us
 )
 
 var (
 	proxy         *haproxy.HAproxy
+	watcher       *SidecarWatcher // Only set in follow mode
 	updateSuccess bool
 )
 
 type CliOpts struct {
-	ConfigFile *string
-	Follow     *string
+	ConfigFile         *string
+	Follow             *string
+	FollowRefresh      *time.Duration
+	FollowStallTimeout *time.Duration
+	FollowMinBackoff   *time.Duration
+	FollowMaxBackoff   *time.Duration
+	Command            string
+	Render             RenderOpts
 }
 
 func parseCommandLine() *CliOpts {
@@ -33,24 +44,33 @@ func parseCommandLine() *CliOpts {
 	app := kingpin.New("haproxy-api", "").DefaultEnvars()
 	opts.ConfigFile = app.Flag("config-file", "The config file to use").
 		Short('f').Default("haproxy-api.toml").String()
-	opts.Follow = app.Flag("follow", "Actively follow this Sidecar's /watch endpoint (format ip:port)").
+	opts.Follow = app.Flag("follow", "Actively follow a Sidecar's /watch endpoint, failing over down the list (format ip:port[,ip:port...])").
 		Short('F').String()
-
-	app.Parse(os.Args[1:])
+	opts.FollowRefresh = app.Flag("follow-refresh", "How often to reconnect to the followed Sidecar's /watch endpoint").
+		Duration()
+	opts.FollowStallTimeout = app.Flag("follow-stall-timeout", "Fail over when the followed Sidecar sends nothing for this long").
+		Duration()
+	opts.FollowMinBackoff = app.Flag("follow-min-backoff", "Shortest wait before trying the next Sidecar after one has failed").
+		Duration()
+	opts.FollowMaxBackoff = app.Flag("follow-max-backoff", "Longest wait before trying the next Sidecar after one has failed").
+		Duration()
+
+	app.Command("run", "Run the API and manage HAproxy (default)").Default()
+
+	render := app.Command("render", "Render a config from a Sidecar state file and print it")
+	opts.Render.StateFile = render.Flag("state", "The Sidecar state JSON to render, or '-' for stdin").
+		Short('s').Default("-").String()
+	opts.Render.Template = render.Flag("template", "The template to use instead of the one from the config file").
+		Short('t').String()
+	opts.Render.Output = render.Flag("output", "Write the config to this file instead of stdout").
+		Short('o').String()
+	opts.Render.Verify = render.Flag("verify", "Check the rendered config with the verify command").Bool()
+
+	opts.Command = kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	return &opts
 }
 
-func run(command string) error {
-	cmd := exec.Command("/bin/bash", "-c", command)
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("Error running '%s': %s", command, err.Error())
-	}
-
-	return err
-}
-
 // Write out the HAproxy config and reload the instance
 func writeAndReload(state *catalog.ServicesState) {
 	log.Info("Updating HAproxy")
@@ -58,11 +78,60 @@ func writeAndReload(state *catalog.ServicesState) {
 	if err != nil {
 		log.Errorf("Failed updating HAproxy: %s", err)
 	} else {
-		log.Info("Success updating HAproxy")
+		log.Infof("Success updating HAproxy: %s", proxy.LastOutcome())
 	}
 	updateSuccess = (err == nil)
 }
 
+// Ask the receiver to render the current state again, if we have one. Used
+// when something other than the state, like the template, has changed.
+func rerender(rcvr *receiver.Receiver) {
+	rcvr.StateLock.Lock()
+	haveState := rcvr.CurrentState != nil
+	rcvr.StateLock.Unlock()
+
+	if haveState {
+		rcvr.EnqueueUpdate()
+	}
+}
+
+// Re-read the template and overrides when we get a SIGHUP. If either fails
+// to parse we keep rendering with the old one.
+func handleSighup(rcvr *receiver.Receiver) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	for range sigChan {
+		log.Info("Got SIGHUP, reloading template and overrides")
+		// A broken one of these shouldn't stop us picking up the other
+		templateErr := proxy.LoadTemplate()
+		if templateErr != nil {
+			log.Errorf("Keeping previous template: %s", templateErr)
+		}
+		overridesErr := proxy.LoadOverrides()
+		if overridesErr != nil {
+			log.Errorf("Keeping previous overrides: %s", overridesErr)
+		}
+
+		if templateErr != nil && overridesErr != nil {
+			continue
+		}
+		rerender(rcvr)
+	}
+}
+
+// Stop the HAproxy we're supervising and exit on SIGTERM or SIGINT. In the
+// container we're PID 1, so nobody else will stop it properly.
+func handleShutdown() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-sigChan
+	log.Infof("Got %s, shutting down", sig)
+	proxy.StopSupervised(ShutdownTimeout)
+	os.Exit(0)
+}
+
 func printConfig(opts *CliOpts, config *Config) {
 	printer := rubberneck.NewPrinter(log.Infof, rubberneck.NoAddLineFeed)
 	printer.PrintWithLabel("HAproxy-API starting", opts, config)
@@ -70,34 +139,86 @@ func printConfig(opts *CliOpts, config *Config) {
 
 func main() {
 	opts := parseCommandLine()
+
+	if opts.Command == "render" {
+		runRender(opts)
+		return
+	}
+
 	config := parseConfig(*opts.ConfigFile)
 
 	printConfig(opts, config)
 
 	proxy = config.HAproxy
 
-	rcvr := receiver.NewReceiver(ReloadBufferSize, writeAndReload)
-	watchUrl, stateUrl := generateUrls(opts, config)
+	// Fail fast if we have a broken template
+	err := proxy.LoadTemplate()
+	if err != nil {
+		log.Fatalf("Unable to load template: %s", err)
+	}
+
+	err = proxy.LoadOverrides()
+	if err != nil {
+		log.Fatalf("Unable to load service overrides: %s", err)
+	}
+
+	// Coalesce bursts of updates before writing and reloading
+	scheduler := proxy.NewScheduler(writeAndReload)
+	go scheduler.Run(director.NewFreeLooper(director.FOREVER, nil))
+
+	rcvr := receiver.NewReceiver(ReloadBufferSize, scheduler.Trigger)
+
+	sidecar, err := NewSidecarClient(config.Sidecar)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each source gets its own receiver, and they're merged into rcvr
+	sourceConfigs := config.Sidecar.sourceConfigs()
+	if *opts.Follow != "" {
+		targets, err := parseFollowTargets(*opts.Follow, sidecar.Scheme)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sourceConfigs = []SourceConfig{{Name: DefaultSourceName, StateUrl: targets[0].StateUrl}}
+		watcher = NewSidecarWatcher(targets, sidecar, director.NewFreeLooper(director.FOREVER, make(chan error)), make(chan WatchUpdate))
+		err = configureWatcher(watcher, opts, config.Sidecar)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	sources := NewSourceSet(sourceConfigs, rcvr, proxy)
+	sources.FetchState = sidecar.FetchState
+
+	// Pick up changes to the template from disk or on SIGHUP
+	templateLooper := director.NewTimedLooper(director.FOREVER, TemplateCheckInterval, nil)
+	go proxy.WatchTemplate(templateLooper, func() { rerender(rcvr) })
+	go handleSighup(rcvr)
+	go handleShutdown()
+
+	// Pick up changes to the per-service overrides
+	overridesLooper := director.NewTimedLooper(director.FOREVER, TemplateCheckInterval, nil)
+	go proxy.WatchOverrides(overridesLooper, func() { rerender(rcvr) })
+
+	// Pick up new or renewed TLS certificates
+	certLooper := director.NewTimedLooper(director.FOREVER, TemplateCheckInterval, nil)
+	go proxy.WatchCerts(certLooper, func() { rerender(rcvr) })
 
 	// If we're in follow mode, do that
 	if *opts.Follow != "" {
 		log.Info("Running in follower mode")
 		checkHAproxyPidFile(config)
-		watchLooper := director.NewFreeLooper(director.FOREVER, make(chan error))
 		processLooper := director.NewFreeLooper(director.FOREVER, make(chan error))
-		go handleFollowing(stateUrl, watchUrl, watchLooper, processLooper, rcvr)
+		go handleFollowing(watcher, processLooper, sources.Default().Receiver)
 	} else {
-		err := rcvr.FetchInitialState(stateUrl)
-		if err == nil {
-			writeAndReload(rcvr.CurrentState)
-		} else {
-			log.Errorf("Failed to fetch state from '%s'... continuing in hopes someone will post it", stateUrl)
-		}
+		// This hands each state to the scheduler when it succeeds
+		sources.FetchInitialStates()
 	}
 
 	// Watch for updates and handle reloading HAproxy
+	go sources.ProcessUpdates()
 	go rcvr.ProcessUpdates()
 
 	// Run the web API and block until it completes
-	serveHttp(config.HAproxyApi.BindIP, config.HAproxyApi.BindPort, rcvr)
+	serveHttp(config.HAproxyApi.BindIP, config.HAproxyApi.BindPort, sources)
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics for the inputs to the update pipeline. The render,
+// verify and reload metrics live in the haproxy package.
+var (
+	updatesReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_updates_received_total",
+		Help: "Number of state updates POSTed to /update for any source",
+	})
+	followerNotificationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_follower_notifications_total",
+		Help: "Number of change notifications received from the followed Sidecar",
+	})
+	followerStateFetchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_follower_state_fetches_total",
+		Help: "Number of full state fetches from the followed Sidecar",
+	})
+	followerFailoversTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "haproxy_api_follower_failovers_total",
+		Help: "Number of times follow mode moved on to the next Sidecar",
+	})
+)
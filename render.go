@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options for the `render` subcommand
+type RenderOpts struct {
+	StateFile *string
+	Template  *string
+	Output    *string
+	Verify    *bool
+}
+
+// Read a serialized ServicesState from a file, or from stdin when the path is "-"
+func readState(path string) (*catalog.ServicesState, error) {
+	var data []byte
+	var err error
+
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read state from '%s': %s", path, err)
+	}
+
+	state, err := catalog.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode state from '%s': %s", path, err)
+	}
+
+	return state, nil
+}
+
+// Use the HAproxy settings from the config file when there is one, otherwise
+// fall back to the defaults so that rendering works without any setup.
+func renderProxy(configFile string) *haproxy.HAproxy {
+	if _, err := os.Stat(configFile); err != nil {
+		log.Debugf("No config file at '%s', using defaults", configFile)
+		return haproxy.New("haproxy.cfg", "haproxy.pid")
+	}
+
+	return parseConfig(configFile).HAproxy
+}
+
+// Render a config from a saved state without touching the running HAproxy.
+// When verify is set, the config is written to a temp file and checked with
+// the verify command before we output it.
+func renderConfig(proxy *haproxy.HAproxy, opts *RenderOpts, output io.Writer) error {
+	if *opts.Template != "" {
+		proxy.Template = *opts.Template
+	}
+
+	state, err := readState(*opts.StateFile)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = proxy.WriteConfig(state, &buf)
+	if err != nil {
+		return err
+	}
+
+	if *opts.Verify {
+		err = verifyRendered(proxy, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = output.Write(buf.Bytes())
+	return err
+}
+
+// Write the rendered config to a temp file and run the verify command on it
+func verifyRendered(proxy *haproxy.HAproxy, config []byte) error {
+	file, err := ioutil.TempFile("", "haproxy-api-render")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(config)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to write temp file: %s", err)
+	}
+
+	return proxy.VerifyFile(file.Name())
+}
+
+// Run the `render` subcommand and exit
+func runRender(opts *CliOpts) {
+	proxy := renderProxy(*opts.ConfigFile)
+	if err := proxy.LoadOverrides(); err != nil {
+		log.Fatalf("Unable to load service overrides: %s", err)
+	}
+
+	// Render it all before touching the output file, so a failure leaves
+	// whatever was there alone
+	var buf bytes.Buffer
+	err := renderConfig(proxy, &opts.Render, &buf)
+	if err != nil {
+		log.Fatalf("Failed to render config: %s", err)
+	}
+
+	if *opts.Render.Output != "" {
+		err = haproxy.WriteFileAtomic(*opts.Render.Output, buf.Bytes(), 0644)
+	} else {
+		_, err = os.Stdout.Write(buf.Bytes())
+	}
+	if err != nil {
+		log.Fatalf("Unable to write config: %s", err)
+	}
+}
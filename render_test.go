@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_renderConfig(t *testing.T) {
+	Convey("renderConfig()", t, func() {
+		hostname := "chaucer"
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Image:    "101deadbeef",
+			Created:  time.Now().UTC(),
+			Updated:  time.Now().UTC(),
+			Hostname: hostname,
+			Status:   service.ALIVE,
+			Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: 9990, IP: "127.0.0.1"}},
+		})
+
+		stateFile, _ := ioutil.TempFile("", "render-state")
+		stateFile.Write(state.Encode())
+		stateFile.Close()
+		defer os.Remove(stateFile.Name())
+
+		proxy := haproxy.New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+		template := "views/haproxy.cfg"
+		verify := false
+		output := ""
+		statePath := stateFile.Name()
+		opts := &RenderOpts{
+			StateFile: &statePath,
+			Template:  &template,
+			Output:    &output,
+			Verify:    &verify,
+		}
+
+		Convey("renders the state with the template", func() {
+			var buf bytes.Buffer
+			err := renderConfig(proxy, opts, &buf)
+
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "frontend bocaccio-9990")
+			So(buf.String(), ShouldContainSubstring, "server chaucer-deadbeef123 127.0.0.1:10450")
+		})
+
+		Convey("returns an error for a missing state file", func() {
+			missing := "/does/not/exist.json"
+			opts.StateFile = &missing
+
+			var buf bytes.Buffer
+			err := renderConfig(proxy, opts, &buf)
+
+			So(err, ShouldNotBeNil)
+			So(buf.Len(), ShouldEqual, 0)
+		})
+
+		Convey("when verifying", func() {
+			verify = true
+
+			Convey("outputs the config when it passes", func() {
+				proxy.VerifyCmd = "/usr/bin/true {{config}}"
+
+				var buf bytes.Buffer
+				err := renderConfig(proxy, opts, &buf)
+
+				So(err, ShouldBeNil)
+				So(buf.String(), ShouldContainSubstring, "frontend bocaccio-9990")
+			})
+
+			Convey("returns an error and no output when it fails", func() {
+				proxy.VerifyCmd = "/usr/bin/false {{config}}"
+
+				var buf bytes.Buffer
+				err := renderConfig(proxy, opts, &buf)
+
+				So(err, ShouldNotBeNil)
+				So(buf.Len(), ShouldEqual, 0)
+			})
+		})
+	})
+}
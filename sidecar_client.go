@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Nitro/sidecar/catalog"
+)
+
+const (
+	STATE_FETCH_TIMEOUT   = 5 * time.Second
+	DIAL_TIMEOUT          = 5 * time.Second
+	TLS_HANDSHAKE_TIMEOUT = 5 * time.Second
+)
+
+// A SidecarClient makes our requests to Sidecar, both for the state and for
+// the /watch stream, with the TLS and authentication settings from the
+// [sidecar] section applied.
+type SidecarClient struct {
+	Scheme      string // For the addresses given to --follow
+	BearerToken string
+	tlsConfig   *tls.Config
+	fetchClient *http.Client
+}
+
+// Return a SidecarClient for the config, loading the CA bundle and client
+// certificate if there are any
+func NewSidecarClient(config *SidecarConfig) (*SidecarClient, error) {
+	client := &SidecarClient{Scheme: "http"}
+
+	if config != nil {
+		client.BearerToken = config.BearerToken
+		if config.UseTLS {
+			client.Scheme = "https"
+		}
+
+		tlsConfig, err := loadTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		client.tlsConfig = tlsConfig
+	}
+
+	client.fetchClient = &http.Client{Timeout: STATE_FETCH_TIMEOUT, Transport: client.Transport()}
+
+	return client, nil
+}
+
+// Build the TLS config for talking to Sidecar, or nil to use the defaults
+func loadTLSConfig(config *SidecarConfig) (*tls.Config, error) {
+	if config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read Sidecar CA file '%s': %s", config.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in Sidecar CA file '%s'", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load Sidecar client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Transport returns a new transport with our TLS settings. Each caller gets
+// its own, since the watcher cancels requests on it. Connecting is bounded so
+// a hung Sidecar can't hold up failover, but the /watch stream itself isn't.
+func (c *SidecarClient) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   DIAL_TIMEOUT,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       c.tlsConfig,
+		TLSHandshakeTimeout:   TLS_HANDSHAKE_TIMEOUT,
+		ResponseHeaderTimeout: 0,
+	}
+}
+
+// NewRequest returns a GET request for the url with our auth header
+func (c *SidecarClient) NewRequest(url string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+
+	return req, nil
+}
+
+// FetchState fetches the state from a Sidecar. It works like the receiver's
+// FetchState, but with our TLS and auth settings.
+func (c *SidecarClient) FetchState(url string) (*catalog.ServicesState, error) {
+	req, err := c.NewRequest(url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Bad status code on state fetch: %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return catalog.Decode(data)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Write a self-signed client certificate and its key to dir
+func writeClientCert(dir string) (*x509.Certificate, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "haproxy-api"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := dir + "/client.pem"
+	keyFile := dir + "/client-key.pem"
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return cert, certFile, keyFile
+}
+
+func Test_SidecarClient(t *testing.T) {
+	Convey("SidecarClient", t, func() {
+		log.SetLevel(log.FatalLevel)
+
+		tmpDir, _ := ioutil.TempDir("", "sidecar-client")
+		defer os.RemoveAll(tmpDir)
+
+		clientCert, certFile, keyFile := writeClientCert(tmpDir)
+
+		// A Sidecar behind TLS that wants a client cert and a bearer token
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer sekrit" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/api/state.json":
+				w.Write(catalog.NewServicesState().Encode())
+			case "/watch":
+				w.Write([]byte(`{}`))
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}))
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(clientCert)
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+		server.StartTLS()
+		defer server.Close()
+
+		caFile := tmpDir + "/ca.pem"
+		ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+		config := &SidecarConfig{
+			UseTLS:      true,
+			CAFile:      caFile,
+			CertFile:    certFile,
+			KeyFile:     keyFile,
+			BearerToken: "sekrit",
+		}
+
+		Convey("fetches the state over TLS", func() {
+			sidecar, err := NewSidecarClient(config)
+			So(err, ShouldBeNil)
+
+			state, err := sidecar.FetchState(server.URL + "/api/state.json")
+			So(err, ShouldBeNil)
+			So(state, ShouldNotBeNil)
+		})
+
+		Convey("fails without the bearer token", func() {
+			config.BearerToken = ""
+			sidecar, _ := NewSidecarClient(config)
+
+			_, err := sidecar.FetchState(server.URL + "/api/state.json")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "401")
+		})
+
+		Convey("fails without the client certificate", func() {
+			config.CertFile = ""
+			config.KeyFile = ""
+			sidecar, _ := NewSidecarClient(config)
+
+			_, err := sidecar.FetchState(server.URL + "/api/state.json")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("follows the /watch stream over TLS", func() {
+			sidecar, _ := NewSidecarClient(config)
+			targets, _ := parseFollowTargets(strings.TrimPrefix(server.URL, "https://"), sidecar.Scheme)
+			So(targets[0].WatchUrl, ShouldStartWith, "https://")
+
+			watcher := NewSidecarWatcher(targets, sidecar, director.NewFreeLooper(director.FOREVER, make(chan error)), make(chan WatchUpdate, 10))
+			go watcher.Follow()
+			defer watcher.looper.Quit()
+
+			So(eventually(func() bool { return watcher.Status().Connected }), ShouldBeTrue)
+		})
+
+		Convey("bounds connecting but doesn't go through a proxy", func() {
+			sidecar, _ := NewSidecarClient(config)
+			tr := sidecar.Transport()
+
+			So(tr.Proxy, ShouldBeNil)
+			So(tr.DialContext, ShouldNotBeNil)
+			So(tr.TLSHandshakeTimeout, ShouldEqual, TLS_HANDSHAKE_TIMEOUT)
+		})
+
+		Convey("rejects a CA file with no certificates", func() {
+			ioutil.WriteFile(caFile, []byte("nope"), 0644)
+
+			_, err := NewSidecarClient(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/Nitro/sidecar/catalog"
@@ -11,39 +14,104 @@ import (
 )
 
 // A SidecarWatcher attaches to the /watch endpoint on a Sidecar instance and
-// sends notifications when something has changed in the remote state.
+// sends notifications when something has changed in the remote state. It is
+// given a list of Sidecars and fails over to the next one when the current
+// one can't be reached or stops sending.
 //
 // haproxy-api uses this when in Follow mode.
 
 const (
 	CONNECTION_REFRESH_TIME = 3 * time.Minute
+	STALL_TIMEOUT           = 10 * time.Second
+	MIN_BACKOFF             = 1 * time.Second
+	MAX_BACKOFF             = 1 * time.Minute
 )
 
 // Heavily modified from @bparli's Traefik provider for Sidecar:
 // https://github.com/Nitro/traefik/blob/master/provider/sidecar.go
 
+// A WatchUpdate is what the watcher sends on its notifyChan: the services
+// streamed from /watch, grouped by name, or nil when the stream couldn't be
+// decoded and the full state should be fetched instead.
+type WatchUpdate map[string][]*service.Service
+
+// A Sidecar instance we can follow
+type FollowTarget struct {
+	Address  string
+	WatchUrl string
+	StateUrl string
+}
+
+// FollowStatus reports which Sidecar we're following
+type FollowStatus struct {
+	Active    string   `json:"active"`
+	Addresses []string `json:"addresses"`
+	Connected bool     `json:"connected"`
+	Failovers int      `json:"failovers"`
+}
+
+// One connection to /watch. The goroutine decoding its stream can outlive
+// it, so once it's closed, anything that goroutine reports is dropped.
+type watchConn struct {
+	events chan struct{}
+	done   chan struct{}
+}
+
+func newWatchConn() *watchConn {
+	return &watchConn{events: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// Stop passing along anything from this connection. Never waits on a callback
+// that is blocked sending to a slow consumer.
+func (c *watchConn) close() {
+	close(c.done)
+}
+
+func (c *watchConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
 type SidecarWatcher struct {
-	RefreshConn time.Duration // How often to refresh the connection to Sidecar backend
-	Client      *http.Client
-	transport   *http.Transport
-	notifyChan  chan struct{}
-	looper      director.Looper
-	timer       *time.Timer
-	url         string
+	RefreshConn  time.Duration // How often to refresh the connection to Sidecar backend
+	StallTimeout time.Duration // How long a connection can go without sending us anything
+	MinBackoff   time.Duration // First wait after a Sidecar has failed
+	MaxBackoff   time.Duration // Longest wait, however many times they fail
+	Client       *http.Client
+	sidecar      *SidecarClient
+	transport    *http.Transport
+	notifyChan   chan WatchUpdate
+	looper       director.Looper
+	targets      []FollowTarget
+	statusLock   sync.Mutex
+	active       int
+	connected    bool
+	failovers    int
+	backoff      time.Duration
+	jitter       *rand.Rand
 }
 
-// Return a new, fully configured SidecarWatcher
-func NewSidecarWatcher(url string, looper director.Looper, notifyChan chan struct{}) *SidecarWatcher {
-	tr := &http.Transport{ResponseHeaderTimeout: 0}
+// Return a new, fully configured SidecarWatcher that uses the sidecar
+// client's TLS and auth settings
+func NewSidecarWatcher(targets []FollowTarget, sidecar *SidecarClient, looper director.Looper, notifyChan chan WatchUpdate) *SidecarWatcher {
+	tr := sidecar.Transport()
 
 	w := &SidecarWatcher{
-		RefreshConn: CONNECTION_REFRESH_TIME,
-		Client:      &http.Client{Timeout: 0, Transport: tr},
-		looper:      looper,
-		transport:   tr,
-		notifyChan:  notifyChan,
-		timer:       time.NewTimer(CONNECTION_REFRESH_TIME),
-		url:         url,
+		RefreshConn:  CONNECTION_REFRESH_TIME,
+		StallTimeout: STALL_TIMEOUT,
+		MinBackoff:   MIN_BACKOFF,
+		MaxBackoff:   MAX_BACKOFF,
+		Client:       &http.Client{Timeout: 0, Transport: tr},
+		sidecar:      sidecar,
+		looper:       looper,
+		transport:    tr,
+		notifyChan:   notifyChan,
+		targets:      targets,
+		jitter:       rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 
 	log.Infof("Using Sidecar connection refresh interval: %s", w.RefreshConn.String())
@@ -52,66 +120,219 @@ func NewSidecarWatcher(url string, looper director.Looper, notifyChan chan struc
 }
 
 // onChange is a callback triggered by changed from the Sidecar /watch
-// endpoint. We don't need the data it sends, but the callback function
-// is required to be of this signature.
-func (w *SidecarWatcher) onChange(state map[string][]*service.Service, err error) {
-	// If something went wrong, we bail, don't reload HAproxy,
-	// and let the connection time out
+// endpoint on conn. The services it sends are passed along on the
+// notifyChan so they can be rendered without fetching the whole state again.
+func (w *SidecarWatcher) onChange(conn *watchConn, services map[string][]*service.Service, err error) {
+	// A connection we've moved on from could only send us old news, and
+	// it errors when we cancel it, which isn't worth a full state fetch
+	if conn.isClosed() {
+		return
+	}
+
+	// If something went wrong, we ask for the full state instead, and the
+	// broken stream will make Follow() reconnect
 	if err != nil {
 		log.Errorf("Got error from stream parser: %s", err.Error())
+		w.send(conn, nil)
 		return
 	}
 
-	w.notify()
+	// Let watch() know this connection is alive
+	select {
+	case conn.events <- struct{}{}:
+	default:
+	}
+
+	// nil means the stream was broken, so a "null" payload is just empty
+	if services == nil {
+		services = WatchUpdate{}
+	}
+	if w.send(conn, services) {
+		followerNotificationsTotal.Inc()
+	}
+}
+
+// How long to wait before trying the next Sidecar after one has failed. The
+// backoff doubles from MinBackoff up to MaxBackoff, and we wait a random
+// time between half of it and all of it so that many followers don't all
+// reconnect at the same moment when a Sidecar comes back.
+func (w *SidecarWatcher) nextBackoff() time.Duration {
+	switch {
+	case w.backoff == 0:
+		w.backoff = w.MinBackoff
+	case w.backoff*2 > w.MaxBackoff:
+		w.backoff = w.MaxBackoff
+	default:
+		w.backoff *= 2
+	}
+
+	half := int64(w.backoff / 2)
+	if half < 1 {
+		return w.backoff
+	}
+
+	return time.Duration(half + w.jitter.Int63n(half+1))
+}
+
+// Utility method to send the right data on the notifyChan, unless the
+// connection is closed while we wait for the consumer. Returns whether it
+// went out.
+func (w *SidecarWatcher) send(conn *watchConn, update WatchUpdate) bool {
+	select {
+	case w.notifyChan <- update:
+		return true
+	case <-conn.done:
+		return false
+	}
+}
+
+// Active returns the Sidecar we're currently following
+func (w *SidecarWatcher) Active() FollowTarget {
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+
+	return w.targets[w.active]
+}
+
+// StateUrl returns the state URL of the Sidecar we're currently following
+func (w *SidecarWatcher) StateUrl() string {
+	return w.Active().StateUrl
+}
+
+// Status reports which Sidecar we're following and how often we've failed over
+func (w *SidecarWatcher) Status() *FollowStatus {
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+
+	var addresses []string
+	for _, target := range w.targets {
+		addresses = append(addresses, target.Address)
+	}
 
-	// Stop and reset the timer
-	if !w.timer.Stop() {
-		<-w.timer.C
+	return &FollowStatus{
+		Active:    w.targets[w.active].Address,
+		Addresses: addresses,
+		Connected: w.connected,
+		Failovers: w.failovers,
 	}
-	w.resetTimer()
 }
 
-// Utility method to rest the timer
-func (w *SidecarWatcher) resetTimer() {
-	w.timer.Reset(w.RefreshConn)
+func (w *SidecarWatcher) setConnected(connected bool) {
+	w.statusLock.Lock()
+	w.connected = connected
+	w.statusLock.Unlock()
 }
 
-// Utility method to send the right data on the notifyChan
-func (w *SidecarWatcher) notify() {
-	w.notifyChan <- struct{}{}
+// Move on to the next Sidecar in the list, if there is one
+func (w *SidecarWatcher) failover() {
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+
+	w.connected = false
+	if len(w.targets) < 2 {
+		return
+	}
+
+	w.active = (w.active + 1) % len(w.targets)
+	w.failovers += 1
+	followerFailoversTotal.Inc()
+	log.Warnf("Failing over to Sidecar %s", w.targets[w.active].Address)
+}
+
+// Watch one open connection until it's time to replace it. Returns false if
+// the stream ended or never sent us anything, so we should fail over.
+func (w *SidecarWatcher) watch(resp *http.Response) bool {
+	conn := newWatchConn()
+	defer conn.close()
+
+	streamDone := make(chan error, 1)
+
+	// DecodeStream will trigger the onChange callback on each event
+	go func() {
+		streamDone <- catalog.DecodeStream(resp.Body, func(services map[string][]*service.Service, err error) {
+			w.onChange(conn, services, err)
+		})
+	}()
+
+	// Both of these are only read here, so it's safe to drain them when
+	// restarting them
+	stall := time.NewTimer(w.StallTimeout)
+	defer stall.Stop()
+
+	refresh := time.NewTimer(w.RefreshConn)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-conn.events:
+			// It's working, so start watching for a stall again from now
+			if !stall.Stop() {
+				<-stall.C
+			}
+			stall.Reset(w.StallTimeout)
+			w.backoff = 0
+			w.setConnected(true)
+
+			if !refresh.Stop() {
+				<-refresh.C
+			}
+			refresh.Reset(w.RefreshConn)
+		case <-stall.C:
+			log.Errorf("Sidecar %s sent nothing for %s", w.Active().Address, w.StallTimeout)
+			return false
+		case <-streamDone:
+			log.Errorf("Lost the stream from Sidecar %s", w.Active().Address)
+			return false
+		case <-refresh.C:
+			return true
+		}
+	}
+}
+
+// Wait out the next backoff
+func (w *SidecarWatcher) sleepBackoff() {
+	delay := w.nextBackoff()
+	log.Infof("Retrying Sidecar in %s", delay)
+	time.Sleep(delay)
 }
 
 // Follow() will attach to the /watch endpoint on a Sidecar instance and
 // send notifications on the notifyChan when something has changed on the
 // remote host. It uses a timer to guarantee that we get a refresh on the
 // open connection every RefreshConn so that we don't end up being
-// orphaned.
+// orphaned. When a Sidecar can't be reached or its stream stalls, it
+// backs off and moves on to the next one.
 func (w *SidecarWatcher) Follow() {
-	var err error
-	var resp *http.Response
-	var req *http.Request
-
 	w.looper.Loop(func() error {
-		req, err = http.NewRequest("GET", w.url, nil)
+		target := w.Active()
+
+		req, err := w.sidecar.NewRequest(target.WatchUrl)
 		if err != nil {
-			log.Errorf("Error creating http request to Sidecar: %s, Error: %s", w.url, err)
+			log.Errorf("Error creating http request to Sidecar: %s, Error: %s", target.WatchUrl, err)
 			return nil
 		}
 
-		resp, err = w.Client.Do(req)
+		resp, err := w.Client.Do(req)
+		if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			resp.Body.Close()
+			err = fmt.Errorf("Bad status code: %d", resp.StatusCode)
+		}
 		if err != nil {
-			log.Errorf("Error connecting to Sidecar: %s, Error: %s", w.url, err)
-			time.Sleep(5 * time.Second)
+			log.Errorf("Error connecting to Sidecar: %s, Error: %s", target.WatchUrl, err)
+			w.failover()
+			w.sleepBackoff()
 			return nil
 		}
 
-		// DecodeStream will trigger the onChange callback on each event
-		go catalog.DecodeStream(resp.Body, w.onChange)
-
-		// Block waiting on the timer to expire
-		<-w.timer.C
-		w.resetTimer()
+		healthy := w.watch(resp)
 		w.transport.CancelRequest(req)
+		resp.Body.Close()
+
+		if !healthy {
+			w.failover()
+			w.sleepBackoff()
+		}
+
 		return nil
 	})
 }
@@ -2,25 +2,35 @@ package main
 
 import (
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Nitro/sidecar/service"
 	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+var plainSidecar, _ = NewSidecarClient(nil)
+
+var exampleTargets = []FollowTarget{
+	{Address: "example.com:7777", WatchUrl: "http://example.com:7777/watch"},
+}
+
 func Test_NewSidecarWatcher(t *testing.T) {
 	Convey("NewSidecarWatcher properly configured a SidecarWatcher", t, func() {
 		log.SetLevel(log.ErrorLevel)
 
 		looper := director.NewFreeLooper(1, make(chan error))
-		notifyChan := make(chan struct{})
-		watcher := NewSidecarWatcher("http://example.com/watch", looper, notifyChan)
+		notifyChan := make(chan WatchUpdate)
+		watcher := NewSidecarWatcher(exampleTargets, plainSidecar, looper, notifyChan)
 
 		So(watcher.looper, ShouldEqual, looper)
 		So(watcher.notifyChan, ShouldEqual, notifyChan)
-		So(watcher.timer, ShouldNotBeNil)
 		So(watcher.RefreshConn, ShouldEqual, CONNECTION_REFRESH_TIME)
 	})
 }
@@ -30,35 +40,252 @@ func Test_onChange(t *testing.T) {
 		log.SetLevel(log.ErrorLevel)
 
 		looper := director.NewFreeLooper(1, make(chan error))
-		notifyChan := make(chan struct{}, 1)
-		watcher := NewSidecarWatcher("http://example.com/watch", looper, notifyChan)
+		notifyChan := make(chan WatchUpdate, 1)
+		watcher := NewSidecarWatcher(exampleTargets, plainSidecar, looper, notifyChan)
+
+		conn := newWatchConn()
 
-		Convey("returns nil on error", func() {
+		Convey("asks for the full state on error", func() {
 			err := errors.New("Oh no!")
-			watcher.onChange(nil, err)
+			watcher.onChange(conn, nil, err)
+
+			So(len(notifyChan), ShouldEqual, 1)
+			So(<-notifyChan, ShouldBeNil)
+		})
+
+		Convey("notifies the channel with the services", func() {
+			services := map[string][]*service.Service{"bocaccio": {{ID: "deadbeef123"}}}
+			watcher.onChange(conn, services, nil)
+
+			So(len(notifyChan), ShouldEqual, 1)
+			So(<-notifyChan, ShouldResemble, WatchUpdate(services))
+		})
+
+		Convey("never sends nil for an empty payload", func() {
+			watcher.onChange(conn, nil, nil)
+
+			So(<-notifyChan, ShouldNotBeNil)
+		})
+
+		Convey("lets the connection know it's alive", func() {
+			watcher.onChange(conn, nil, nil)
+
+			So(len(conn.events), ShouldEqual, 1)
+		})
+
+		Convey("doesn't ask for the full state when we closed the connection", func() {
+			conn.close()
+			watcher.onChange(conn, nil, errors.New("use of closed network connection"))
+
+			So(len(notifyChan), ShouldEqual, 0)
+		})
+
+		Convey("ignores services from a closed connection", func() {
+			conn.close()
+			services := map[string][]*service.Service{"bocaccio": {{ID: "deadbeef123"}}}
+			watcher.onChange(conn, services, nil)
 
 			So(len(notifyChan), ShouldEqual, 0)
+			So(len(conn.events), ShouldEqual, 0)
 		})
 
-		Convey("notifies the channel", func() {
-			watcher.onChange(nil, nil)
+		Convey("gives up on a slow consumer once the connection is closed", func() {
+			notifyChan <- WatchUpdate{} // Nobody is reading, so the next send blocks
+
+			sent := make(chan struct{})
+			go func() {
+				watcher.onChange(conn, nil, nil)
+				close(sent)
+			}()
+
+			So(eventually(func() bool { return len(conn.events) == 1 }), ShouldBeTrue)
+			conn.close()
 
+			So(eventually(func() bool {
+				select {
+				case <-sent:
+					return true
+				default:
+					return false
+				}
+			}), ShouldBeTrue)
 			So(len(notifyChan), ShouldEqual, 1)
 		})
+	})
+}
+
+// Poll until the condition is true, or give up after a second
+func eventually(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
 
-		Convey("resets the Timer", func() {
-			watcher.RefreshConn = time.Duration(0)
-			watcher.onChange(nil, nil)
+func Test_Follow(t *testing.T) {
+	Convey("Follow()", t, func() {
+		log.SetLevel(log.FatalLevel)
+
+		// A busy Sidecar that keeps streaming its state like /watch
+		streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := time.After(time.Second)
+			for {
+				w.Write([]byte(`{"bocaccio":[]}`))
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-timeout:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}))
+		defer streaming.Close()
+
+		// A Sidecar that sends its state once and then nothing more
+		var connections int32
+		quiet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&connections, 1)
+			w.Write([]byte(`{"bocaccio":[]}`))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer quiet.Close()
 
-			// We know it was reset if it expires right away because it's
-			// reset to the value of RefreshConn instead of the default.
-			var expired bool
+		// A Sidecar that accepts the connection and never sends anything
+		stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
 			select {
-			case <-watcher.timer.C:
-				expired = true
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer stalled.Close()
+
+		// A Sidecar that has gone away
+		gone := httptest.NewServer(http.NotFoundHandler())
+		gone.Close()
+
+		targetFor := func(server *httptest.Server) FollowTarget {
+			address := strings.TrimPrefix(server.URL, "http://")
+			targets, _ := parseFollowTargets(address, "http")
+			return targets[0]
+		}
+
+		var notifications, fetches int32
+		follow := func(refresh time.Duration, stall time.Duration, targets ...FollowTarget) *SidecarWatcher {
+			notifyChan := make(chan WatchUpdate)
+			watcher := NewSidecarWatcher(targets, plainSidecar, director.NewFreeLooper(director.FOREVER, make(chan error)), notifyChan)
+			watcher.RefreshConn = refresh
+			watcher.StallTimeout = stall
+			watcher.MinBackoff = 10 * time.Millisecond
+			watcher.MaxBackoff = 20 * time.Millisecond
+			go func() {
+				for update := range notifyChan {
+					if update == nil {
+						atomic.AddInt32(&fetches, 1)
+					}
+					atomic.AddInt32(&notifications, 1)
+				}
+			}()
+			go watcher.Follow()
+			return watcher
+		}
+
+		Convey("fails over when a Sidecar can't be reached", func() {
+			watcher := follow(CONNECTION_REFRESH_TIME, 50*time.Millisecond, targetFor(gone), targetFor(streaming))
+			defer watcher.looper.Quit()
+
+			So(eventually(func() bool { return watcher.Status().Connected }), ShouldBeTrue)
+			So(watcher.Active().Address, ShouldEqual, targetFor(streaming).Address)
+			So(watcher.StateUrl(), ShouldEqual, streaming.URL+"/api/state.json")
+			So(watcher.Status().Failovers, ShouldEqual, 1)
+		})
+
+		Convey("fails over when a Sidecar's stream stalls", func() {
+			watcher := follow(CONNECTION_REFRESH_TIME, 50*time.Millisecond, targetFor(stalled), targetFor(streaming))
+			defer watcher.looper.Quit()
+
+			So(eventually(func() bool { return watcher.Status().Connected }), ShouldBeTrue)
+			So(watcher.Active().Address, ShouldEqual, targetFor(streaming).Address)
+		})
+
+		Convey("fails over when a Sidecar's stream stops after it started", func() {
+			watcher := follow(CONNECTION_REFRESH_TIME, 50*time.Millisecond, targetFor(quiet), targetFor(streaming))
+			defer watcher.looper.Quit()
+
+			So(eventually(func() bool {
+				return watcher.Status().Connected && watcher.Active().Address == targetFor(streaming).Address
+			}), ShouldBeTrue)
+			So(watcher.Status().Failovers, ShouldEqual, 1)
+		})
+
+		Convey("replaces the connection every RefreshConn", func() {
+			watcher := follow(50*time.Millisecond, time.Second, targetFor(quiet))
+			defer watcher.looper.Quit()
+
+			So(eventually(func() bool { return atomic.LoadInt32(&connections) >= 4 }), ShouldBeTrue)
+			So(watcher.Status().Failovers, ShouldEqual, 0)
+			So(atomic.LoadInt32(&notifications), ShouldBeGreaterThanOrEqualTo, 3)
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_nextBackoff(t *testing.T) {
+	Convey("nextBackoff()", t, func() {
+		watcher := NewSidecarWatcher(exampleTargets, plainSidecar, director.NewFreeLooper(1, nil), nil)
+		watcher.MinBackoff = 1 * time.Second
+		watcher.MaxBackoff = 5 * time.Second
+
+		Convey("backs off exponentially up to the max", func() {
+			var backoffs []time.Duration
+			for i := 0; i < 5; i++ {
+				watcher.nextBackoff()
+				backoffs = append(backoffs, watcher.backoff)
+			}
+			So(backoffs, ShouldResemble, []time.Duration{
+				1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+			})
+		})
+
+		Convey("waits between half and all of the backoff", func() {
+			for i := 0; i < 20; i++ {
+				delay := watcher.nextBackoff()
+				So(delay, ShouldBeGreaterThanOrEqualTo, watcher.backoff/2)
+				So(delay, ShouldBeLessThanOrEqualTo, watcher.backoff)
 			}
+		})
+	})
+}
+
+func Test_parseFollowTargets(t *testing.T) {
+	Convey("parseFollowTargets()", t, func() {
+		Convey("builds the URLs for each address in order", func() {
+			targets, err := parseFollowTargets("10.0.0.1:7777, 10.0.0.2:7777", "http")
+
+			So(err, ShouldBeNil)
+			So(targets, ShouldResemble, []FollowTarget{
+				{Address: "10.0.0.1:7777", WatchUrl: "http://10.0.0.1:7777/watch", StateUrl: "http://10.0.0.1:7777/api/state.json"},
+				{Address: "10.0.0.2:7777", WatchUrl: "http://10.0.0.2:7777/watch", StateUrl: "http://10.0.0.2:7777/api/state.json"},
+			})
+		})
+
+		Convey("rejects an empty list", func() {
+			_, err := parseFollowTargets(" , ", "http")
+			So(err, ShouldNotBeNil)
+		})
 
-			So(expired, ShouldBeTrue)
+		Convey("rejects addresses with a path", func() {
+			_, err := parseFollowTargets("10.0.0.1:7777/watch", "http")
+			So(err, ShouldNotBeNil)
 		})
 	})
 }
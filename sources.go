@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Nitro/haproxy-api/haproxy"
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/receiver"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSourceName = "default"
+)
+
+// A Source is one named Sidecar cluster that we take state from. It has its
+// own receiver, which gets updates POSTed to /update/<name>.
+type Source struct {
+	Name     string
+	StateUrl string
+	Receiver *receiver.Receiver
+}
+
+// SourceStatus is how fresh the state from one source is
+type SourceStatus struct {
+	LastChanged time.Time `json:"last_changed"`
+	LastUpdated time.Time `json:"last_updated"`
+	HasState    bool      `json:"has_state"`
+}
+
+// A SourceSet merges the states from all of its sources into the one
+// receiver that drives HAproxy, so the rest of haproxy-api sees a single
+// state.
+type SourceSet struct {
+	Sources    []*Source
+	Merged     *receiver.Receiver
+	FetchState func(url string) (*catalog.ServicesState, error)
+
+	proxy       *haproxy.HAproxy
+	lock        sync.Mutex
+	states      map[string]*catalog.ServicesState
+	lastUpdated map[string]time.Time
+}
+
+// Return a SourceSet with a receiver for each of the configured sources. The
+// proxy is told where each service came from on every merge, and may be nil.
+func NewSourceSet(configs []SourceConfig, merged *receiver.Receiver, proxy *haproxy.HAproxy) *SourceSet {
+	sources := &SourceSet{
+		Merged:      merged,
+		FetchState:  receiver.FetchState,
+		proxy:       proxy,
+		states:      make(map[string]*catalog.ServicesState),
+		lastUpdated: make(map[string]time.Time),
+	}
+
+	for _, config := range configs {
+		source := &Source{Name: config.Name, StateUrl: config.StateUrl}
+
+		// The merged receiver holds down between updates, so these don't have to
+		source.Receiver = receiver.NewReceiver(ReloadBufferSize, func(state *catalog.ServicesState) {
+			sources.update(source, state)
+		})
+		source.Receiver.Looper = director.NewFreeLooper(director.FOREVER, make(chan error))
+
+		sources.Sources = append(sources.Sources, source)
+	}
+
+	return sources
+}
+
+// Get returns the named source, or nil if there isn't one
+func (s *SourceSet) Get(name string) *Source {
+	for _, source := range s.Sources {
+		if source.Name == name {
+			return source
+		}
+	}
+
+	return nil
+}
+
+// Default returns the first source, which gets updates POSTed to /update
+func (s *SourceSet) Default() *Source {
+	if len(s.Sources) < 1 {
+		return nil
+	}
+
+	return s.Sources[0]
+}
+
+// Store the new state for a source, then merge all of them and hand the
+// result to the merged receiver
+func (s *SourceSet) update(source *Source, state *catalog.ServicesState) {
+	s.lock.Lock()
+	s.states[source.Name] = state
+	s.lastUpdated[source.Name] = time.Now().UTC()
+	merged, hostSources := haproxy.MergeStates(s.states)
+	s.lock.Unlock()
+
+	if s.proxy != nil {
+		s.proxy.SetSources(hostSources)
+	}
+
+	source.Receiver.StateLock.Lock()
+	lastSvcChanged := source.Receiver.LastSvcChanged
+	source.Receiver.StateLock.Unlock()
+
+	s.Merged.StateLock.Lock()
+	s.Merged.CurrentState = merged
+	if lastSvcChanged != nil {
+		s.Merged.LastSvcChanged = lastSvcChanged
+	}
+	s.Merged.StateLock.Unlock()
+
+	s.Merged.EnqueueUpdate()
+}
+
+// Status reports the freshness of each source's state
+func (s *SourceSet) Status() map[string]SourceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := make(map[string]SourceStatus, len(s.Sources))
+	for _, source := range s.Sources {
+		state := s.states[source.Name]
+		sourceStatus := SourceStatus{
+			LastUpdated: s.lastUpdated[source.Name],
+			HasState:    state != nil,
+		}
+		if state != nil {
+			sourceStatus.LastChanged = state.LastChanged
+		}
+		status[source.Name] = sourceStatus
+	}
+
+	return status
+}
+
+// FetchInitialStates bootstraps each source from its Sidecar. A source that
+// fails is left empty until someone POSTs an update for it. Unlike the
+// receiver's FetchInitialState, we don't hold its lock while merging.
+func (s *SourceSet) FetchInitialStates() {
+	for _, source := range s.Sources {
+		log.Infof("Fetching initial state for source '%s'...", source.Name)
+		state, err := s.FetchState(source.StateUrl)
+		if err != nil {
+			log.Errorf("Failed to fetch state for source '%s' from '%s'... continuing in hopes someone will post it",
+				source.Name, source.StateUrl)
+			continue
+		}
+
+		source.Receiver.StateLock.Lock()
+		source.Receiver.CurrentState = state
+		source.Receiver.StateLock.Unlock()
+
+		s.update(source, state)
+	}
+}
+
+// ProcessUpdates handles the updates for every source. This is a blocking
+// call.
+func (s *SourceSet) ProcessUpdates() {
+	var wg sync.WaitGroup
+	for _, source := range s.Sources {
+		wg.Add(1)
+		go func(rcvr *receiver.Receiver) {
+			defer wg.Done()
+			rcvr.ProcessUpdates()
+		}(source.Receiver)
+	}
+	wg.Wait()
+}
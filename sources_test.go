@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar/catalog"
+	"github.com/Nitro/sidecar/receiver"
+	"github.com/Nitro/sidecar/service"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A state with one service on one host, POSTed as a StateChangedEvent
+func sourceEvent(hostname string, changed time.Time) []byte {
+	svc := service.Service{
+		ID: "deadbeef123", Name: "bocaccio", Hostname: hostname,
+		Updated: changed, Status: service.ALIVE,
+	}
+
+	state := catalog.NewServicesState()
+	state.AddServiceEntry(svc)
+	state.LastChanged = changed
+
+	data, _ := json.Marshal(catalog.StateChangedEvent{
+		State:       state,
+		ChangeEvent: catalog.ChangeEvent{Service: svc, PreviousStatus: service.UNKNOWN},
+	})
+	return data
+}
+
+func Test_SourceSet(t *testing.T) {
+	Convey("SourceSet", t, func() {
+		merged := &receiver.Receiver{ReloadChan: make(chan time.Time, 10)}
+		sources := NewSourceSet([]SourceConfig{
+			{Name: "staging"},
+			{Name: "prod-east"},
+		}, merged, nil)
+
+		router := mux.NewRouter()
+		router.HandleFunc("/update", wrapSourcesHandler(updateHandler, sources))
+		router.HandleFunc("/update/{source}", wrapSourcesHandler(updateHandler, sources))
+
+		post := func(path string, body []byte) int {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("POST", path, bytes.NewBuffer(body)))
+			return recorder.Result().StatusCode
+		}
+
+		// Hand anything the source receivers queued to the merge, like
+		// ProcessUpdates does
+		flush := func() {
+			for _, source := range sources.Sources {
+				for len(source.Receiver.ReloadChan) > 0 {
+					<-source.Receiver.ReloadChan
+					sources.update(source, source.Receiver.CurrentState)
+				}
+			}
+		}
+
+		start := time.Now().UTC()
+		changed := start.Round(time.Second)
+
+		Convey("sends /update to the first source", func() {
+			So(post("/update", sourceEvent("chaucer", changed)), ShouldEqual, 200)
+			So(sources.Get("staging").Receiver.CurrentState.HasServer("chaucer"), ShouldBeTrue)
+			So(sources.Get("prod-east").Receiver.CurrentState, ShouldBeNil)
+		})
+
+		Convey("rejects updates for unknown sources", func() {
+			So(post("/update/nope", sourceEvent("chaucer", changed)), ShouldEqual, 404)
+		})
+
+		Convey("merges the state of every source", func() {
+			post("/update/staging", sourceEvent("chaucer", changed))
+			post("/update/prod-east", sourceEvent("boccaccio", changed.Add(time.Second)))
+			flush()
+
+			So(merged.CurrentState.HasServer("chaucer"), ShouldBeTrue)
+			So(merged.CurrentState.HasServer("boccaccio"), ShouldBeTrue)
+			So(merged.LastSvcChanged.Hostname, ShouldEqual, "boccaccio")
+			So(len(merged.ReloadChan), ShouldEqual, 2)
+
+			Convey("and reports the freshness of each", func() {
+				status := sources.Status()
+				So(status["staging"].HasState, ShouldBeTrue)
+				So(status["staging"].LastChanged, ShouldEqual, changed)
+				So(status["prod-east"].LastChanged, ShouldEqual, changed.Add(time.Second))
+				So(status["prod-east"].LastUpdated, ShouldHappenOnOrAfter, start)
+			})
+		})
+
+		Convey("reports sources with no state yet", func() {
+			So(sources.Status()["prod-east"].HasState, ShouldBeFalse)
+		})
+	})
+}
+
+func Test_validateSources(t *testing.T) {
+	Convey("validateSources()", t, func() {
+		Convey("accepts uniquely named sources", func() {
+			So(validateSources([]SourceConfig{{Name: "a"}, {Name: "b"}}), ShouldBeNil)
+		})
+
+		Convey("rejects sources with no name", func() {
+			So(validateSources([]SourceConfig{{StateUrl: "http://x"}}), ShouldNotBeNil)
+		})
+
+		Convey("rejects duplicate names", func() {
+			So(validateSources([]SourceConfig{{Name: "a"}, {Name: "a"}}), ShouldNotBeNil)
+		})
+	})
+}